@@ -4,12 +4,18 @@ go 1.20
 
 require (
 	github.com/apex/log v1.9.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/kvaster/apexutils v0.0.4
+	go.etcd.io/bbolt v1.3.9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/jwalton/go-supportscolor v1.1.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	golang.org/x/sys v0.0.0-20210220050731-9a76102bfb43 // indirect
-	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.5.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/term v0.6.0 // indirect
 )
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"github.com/apex/log"
 	"github.com/kvaster/apexutils"
 	"mobell-proxy/mobell"
+	"mobell-proxy/mobell/config"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+var configFile = flag.String("config", "", "config file, reloaded on SIGHUP")
 var listenAddr = flag.String("listen.addr", ":8080", "listen address and port")
 var mobotixAddr = flag.String("mobotix.addr", "", "mobotix camera address (ip:port)")
 var mobotixUser = flag.String("mobotix.user", "", "mobotix camera user")
 var mobotixPass = flag.String("mobotix.pass", "", "mobotix camera password")
+var mobotixPassFile = flag.String("mobotix.pass.file", "", "file with mobotix camera password")
+var mobotixPassEnv = flag.String("mobotix.pass.env", "", "environment variable with mobotix camera password")
 var iface = flag.String("iface", "", "interface name for mac address detection")
 var keepAliveSeconds = flag.Int("keepalive", 90, "delay between ping in seconds")
 
@@ -24,9 +29,116 @@ func main() {
 
 	log.Info("starting mobell proxy")
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.WithError(err).Error("error loading config")
+		os.Exit(1)
+	}
+
+	mac, err := detectMac(cfg.Iface)
+	if err != nil {
+		log.WithError(err).Error("can't detect mac address")
+		os.Exit(1)
+	}
+
+	p := mobell.NewProxy()
+
+	if err := p.Start(cfg, mac); err != nil {
+		log.WithError(err).Error("error starting mobell proxy")
+		os.Exit(1)
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+
+	for running := true; running; {
+		select {
+		case <-hupChan:
+			reload(p)
+		case <-stopChan:
+			running = false
+		}
+	}
+
+	log.Info("stopping mobell proxy")
+	p.Stop()
+
+	log.Info("stopped mobell proxy")
+}
+
+func reload(p *mobell.Proxy) {
+	if *configFile == "" {
+		log.Warn("config file is not provided, nothing to reload")
+		return
+	}
+
+	log.Info("reloading config")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.WithError(err).Error("error loading config, keeping old one")
+		return
+	}
+
+	mac, err := detectMac(cfg.Iface)
+	if err != nil {
+		log.WithError(err).Error("can't detect mac address, keeping old config")
+		return
+	}
+
+	if err := p.Reload(cfg, mac); err != nil {
+		log.WithError(err).Error("error applying config")
+		return
+	}
+
+	log.Info("config reloaded")
+}
+
+func loadConfig() (*config.Config, error) {
+	var cfg *config.Config
+
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = c
+	} else {
+		cfg = config.Default()
+		cfg.Listen = *listenAddr
+		cfg.Iface = *iface
+		cfg.KeepAlive = *keepAliveSeconds
+		cfg.Camera = config.Camera{
+			Addr:     *mobotixAddr,
+			User:     *mobotixUser,
+			Pass:     *mobotixPass,
+			PassFile: *mobotixPassFile,
+			PassEnv:  *mobotixPassEnv,
+		}
+
+		if err := cfg.Resolve(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.LogLevel != "" {
+		l, err := log.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		log.SetLevel(l)
+	}
+
+	return cfg, nil
+}
+
+func detectMac(name string) (string, error) {
 	var hwAddr net.HardwareAddr
 	ifs, _ := net.Interfaces()
-	if *iface == "" {
+	if name == "" {
 		for _, iv := range ifs {
 			if iv.HardwareAddr != nil {
 				hwAddr = iv.HardwareAddr
@@ -35,7 +147,7 @@ func main() {
 		}
 	} else {
 		for _, iv := range ifs {
-			if iv.Name == *iface {
+			if iv.Name == name {
 				hwAddr = iv.HardwareAddr
 				break
 			}
@@ -43,30 +155,8 @@ func main() {
 	}
 
 	if hwAddr == nil {
-		log.Error("can't detect mac address")
-		os.Exit(1)
-	}
-
-	mac := hwAddr.String()
-
-	if *mobotixAddr == "" {
-		log.Error("-mobotix.addr is not povided")
-		os.Exit(1)
-	}
-
-	s := mobell.New(*listenAddr, *mobotixAddr, *mobotixUser, *mobotixPass, mac, *keepAliveSeconds)
-
-	if err := s.Start(); err != nil {
-		log.WithError(err).Error("error starting mobell proxy")
-		os.Exit(1)
+		return "", errors.New("no hardware address found")
 	}
 
-	stopChan := make(chan os.Signal)
-	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	<-stopChan
-
-	log.Info("stopping mobell proxy")
-	s.Stop()
-
-	log.Info("stopped mobell proxy")
+	return hwAddr.String(), nil
 }
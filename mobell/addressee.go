@@ -0,0 +1,118 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/event"
+	"mobell-proxy/mobell/protocol"
+)
+
+// addressee is a bell button of door station
+type addressee struct {
+	event.Addressee
+	// addressee from camera, it is forwarded to clients as is
+	value protocol.Addressee
+}
+
+// used until addressees are received from camera
+var defaultAddressee = newAddressee(protocol.Addressee{Id: 1, Name: "Main Bell"})
+
+func newAddressee(a protocol.Addressee) *addressee {
+	return &addressee{
+		Addressee: event.Addressee{Id: a.Id, Name: a.Name},
+		value:     a,
+	}
+}
+
+// newAddressees converts list_addressees result
+func newAddressees(r protocol.ListAddresseesResult) []*addressee {
+	var list []*addressee
+	for _, a := range r {
+		list = append(list, newAddressee(a))
+	}
+
+	return list
+}
+
+// filterAddressees returns addressees with given ids, all addressees are returned when ids are empty
+func filterAddressees(list []*addressee, ids []int) []*addressee {
+	if len(ids) == 0 {
+		return list
+	}
+
+	var filtered []*addressee
+	for _, a := range list {
+		for _, id := range ids {
+			if a.Id == id {
+				filtered = append(filtered, a)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+func addresseeIds(list []*addressee) []int {
+	ids := make([]int, 0, len(list))
+	for _, a := range list {
+		ids = append(ids, a.Id)
+	}
+
+	return ids
+}
+
+func equalIds(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ringAddressee returns addressee of current or last ring, must be called from server loop
+func (s *Server) ringAddressee() *addressee {
+	if s.ring.addressee != nil {
+		return s.ring.addressee
+	}
+
+	if len(s.addressees) > 0 {
+		return s.addressees[0]
+	}
+
+	return defaultAddressee
+}
+
+// addresseeList returns registered addressees in camera format
+func (s *Server) addresseeList() protocol.ListAddresseesResult {
+	var list protocol.ListAddresseesResult
+
+	s.call(func() {
+		for _, a := range s.addressees {
+			list = append(list, a.value)
+		}
+	})
+
+	if len(list) == 0 {
+		list = append(list, defaultAddressee.value)
+	}
+
+	return list
+}
+
+// subscribe sets bell buttons for client, client receives all bells when ids are empty
+func (s *Server) subscribe(conn *connection, ids []int) {
+	s.exec(func() {
+		conn.addressees = nil
+		if len(ids) > 0 {
+			conn.addressees = make(map[int]bool)
+			for _, id := range ids {
+				conn.addressees[id] = true
+			}
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package mobell
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type cameraStatus struct {
+	Name      string     `json:"name"`
+	Connected bool       `json:"connected"`
+	LastFrame *time.Time `json:"last_frame"`
+	Ringing   bool       `json:"ringing"`
+	RingStart *time.Time `json:"ring_start"`
+	// response to the last ring
+	Answer *ringAnswer `json:"answer"`
+	// id of client which is talking right now
+	AudioClient *uint64 `json:"audio_client"`
+	RtspClients int     `json:"rtsp_clients"`
+}
+
+type clientInfo struct {
+	Id        uint64 `json:"id"`
+	Camera    string `json:"camera"`
+	Addr      string `json:"addr"`
+	User      string `json:"user,omitempty"`
+	Video     bool   `json:"video"`
+	Bell      bool   `json:"bell"`
+	BytesSent uint64 `json:"bytes_sent"`
+}
+
+func (s *Server) status() cameraStatus {
+	st := cameraStatus{
+		Name:        s.name,
+		Connected:   s.client.Connected(),
+		RtspClients: s.rtsp.Readers(),
+	}
+
+	s.call(func() {
+		if !s.lastFrame.IsZero() {
+			t := s.lastFrame
+			st.LastFrame = &t
+		}
+
+		st.Ringing = s.ring.ringing
+		if !s.ring.start.IsZero() {
+			t := s.ring.start
+			st.RingStart = &t
+		}
+		if s.ring.answer != nil {
+			a := *s.ring.answer
+			st.Answer = &a
+		}
+
+		if s.audioConn != nil {
+			id := s.audioConn.id
+			st.AudioClient = &id
+		}
+	})
+
+	return st
+}
+
+func (s *Server) clients() []clientInfo {
+	var clients []clientInfo
+
+	s.call(func() {
+		for e := s.conns.Front(); e != nil; e = e.Next() {
+			c := e.Value.(*connection)
+			clients = append(clients, clientInfo{
+				Id:        c.id,
+				Camera:    s.name,
+				Addr:      c.remoteAddr,
+				User:      c.user,
+				Video:     c.videoEnabled,
+				Bell:      c.bellEvtId > 0,
+				BytesSent: atomic.LoadUint64(&c.bytesSent),
+			})
+		}
+	})
+
+	return clients
+}
+
+func (p *Proxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleAdmin); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cameras := make([]cameraStatus, 0)
+	for _, s := range p.serverList() {
+		cameras = append(cameras, s.status())
+	}
+
+	writeJson(w, map[string]interface{}{"cameras": cameras})
+}
+
+func (p *Proxy) handleClients(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleAdmin); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clients := make([]clientInfo, 0)
+	for _, s := range p.serverList() {
+		clients = append(clients, s.clients()...)
+	}
+
+	writeJson(w, clients)
+}
+
+// handleClient handles /api/clients/{id}
+func (p *Proxy) handleClient(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleAdmin); !ok {
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/clients/"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad client id", http.StatusBadRequest)
+		return
+	}
+
+	for _, s := range p.serverList() {
+		if s.kick(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	http.Error(w, "client not found", http.StatusNotFound)
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNoCredentials = errors.New("no credentials")
+var ErrBadCredentials = errors.New("bad credentials")
+var ErrStaleNonce = errors.New("stale nonce")
+
+const nonceLifetime = 5 * time.Minute
+
+// User is a local user, Hash is htdigest compatible: md5(name:realm:password).
+// Users with empty hash can't authenticate with password.
+type User struct {
+	Name string
+	Hash string
+}
+
+// Authenticator checks http Basic and Digest credentials against local user list
+type Authenticator struct {
+	realm  string
+	users  map[string]User
+	secret []byte
+}
+
+func New(realm string, users []User) *Authenticator {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+
+	a := &Authenticator{
+		realm:  realm,
+		users:  make(map[string]User),
+		secret: secret,
+	}
+
+	for _, u := range users {
+		u.Hash = strings.ToLower(u.Hash)
+		a.users[u.Name] = u
+	}
+
+	return a
+}
+
+// Enabled returns false when there are no users, in this case all requests are allowed
+func (a *Authenticator) Enabled() bool {
+	return a != nil && len(a.users) > 0
+}
+
+// Hash calculates password hash for user
+func Hash(name string, realm string, password string) string {
+	return md5hex(name + ":" + realm + ":" + password)
+}
+
+// Check validates Authorization header value and returns user name
+func (a *Authenticator) Check(method string, uri string, authorization string) (string, error) {
+	scheme, value, _ := strings.Cut(authorization, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return a.checkBasic(strings.TrimSpace(value))
+	case "digest":
+		return a.checkDigest(method, uri, ParseParams(value))
+	default:
+		return "", ErrNoCredentials
+	}
+}
+
+// Challenge returns WWW-Authenticate header values, stale should be set when nonce was expired
+func (a *Authenticator) Challenge(stale bool) []string {
+	digest := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, a.realm, a.nonce(time.Now()))
+	if stale {
+		digest += ", stale=true"
+	}
+
+	return []string{digest, fmt.Sprintf(`Basic realm="%s"`, a.realm)}
+}
+
+func (a *Authenticator) checkBasic(value string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", ErrBadCredentials
+	}
+
+	name, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", ErrBadCredentials
+	}
+
+	u, ok := a.users[name]
+	if !ok || u.Hash == "" || !equal(u.Hash, Hash(name, a.realm, password)) {
+		return "", ErrBadCredentials
+	}
+
+	return name, nil
+}
+
+func (a *Authenticator) checkDigest(method string, uri string, p map[string]string) (string, error) {
+	name := p["username"]
+
+	u, ok := a.users[name]
+	if !ok || u.Hash == "" || p["realm"] != a.realm || p["uri"] != uri {
+		return "", ErrBadCredentials
+	}
+
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", ErrBadCredentials
+	}
+
+	nonce := p["nonce"]
+	if err := a.checkNonce(nonce, time.Now()); err != nil {
+		return "", err
+	}
+
+	ha2 := md5hex(method + ":" + uri)
+
+	var expected string
+	switch p["qop"] {
+	case "":
+		expected = md5hex(u.Hash + ":" + nonce + ":" + ha2)
+	case "auth":
+		expected = md5hex(u.Hash + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+	default:
+		return "", ErrBadCredentials
+	}
+
+	if !equal(strings.ToLower(p["response"]), expected) {
+		return "", ErrBadCredentials
+	}
+
+	return name, nil
+}
+
+// nonce is a timestamp signed with server secret, so we don't need to store issued nonces
+func (a *Authenticator) nonce(t time.Time) string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+
+	m := hmac.New(sha256.New, a.secret)
+	m.Write(b)
+
+	return base64.RawURLEncoding.EncodeToString(m.Sum(b))
+}
+
+func (a *Authenticator) checkNonce(nonce string, now time.Time) error {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return ErrBadCredentials
+	}
+
+	m := hmac.New(sha256.New, a.secret)
+	m.Write(b[:8])
+	if !hmac.Equal(m.Sum(nil), b[8:]) {
+		return ErrBadCredentials
+	}
+
+	t := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if now.Sub(t) > nonceLifetime {
+		return ErrStaleNonce
+	}
+
+	return nil
+}
+
+// ParseParams parses comma separated key=value pairs with optionally quoted values
+func ParseParams(s string) map[string]string {
+	p := make(map[string]string)
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return p
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return p
+		}
+
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			i = strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			value = strings.TrimSpace(s[:i])
+			s = s[i:]
+		}
+
+		p[key] = value
+	}
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func equal(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,117 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"mobell-proxy/mobell/protocol"
+	"strconv"
+	"strings"
+)
+
+// cameraEventTypes maps camera event names to event types
+func cameraEventTypes(cfg config.CameraEvents) map[string]event.Type {
+	types := make(map[string]event.Type)
+
+	add := func(t event.Type, names []string) {
+		for _, name := range names {
+			types[strings.ToLower(name)] = t
+		}
+	}
+
+	add(event.Motion, cfg.Motion)
+	add(event.Access, cfg.Access)
+	add(event.Tamper, cfg.Tamper)
+	add(event.Input, cfg.Input)
+
+	return types
+}
+
+func (s *Server) cameraEventType(name string) (event.Type, bool) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	t, ok := s.camEvents[strings.ToLower(name)]
+
+	return t, ok
+}
+
+// OnEvent handles unsolicited camera events: notifications {"method": name, "params": ...}
+// and results [name, params...] without registered listener
+func (s *Server) OnEvent(m *protocol.Message) bool {
+	if m.Method != "" {
+		var params interface{}
+		if len(m.Params) > 0 {
+			params = m.Params
+		}
+		s.onCameraEvent(m.Method, params)
+		return true
+	}
+
+	// responses to commands sent without listener are not events
+	var e protocol.DeviceEvent
+	if m.DecodeResult("", &e) != nil {
+		return true
+	}
+
+	s.onCameraEvent(e.Name, e.Params)
+
+	return true
+}
+
+// onCameraEvent publishes known camera events to event bus
+func (s *Server) onCameraEvent(name string, params interface{}) {
+	t, ok := s.cameraEventType(name)
+	if !ok {
+		s.log.WithField("name", name).Debug("unknown camera event")
+		return
+	}
+
+	s.log.WithField("name", name).WithField("type", t).Debug("received camera event")
+
+	e := s.event(t, nil)
+	e.Name = name
+	e.Params = params
+	s.proxy.publish(e)
+}
+
+// clientSink sends events to client as continuation of subscribe_events request
+type clientSink struct {
+	c  *connection
+	id int
+}
+
+func (cs clientSink) Publish(e event.Event) {
+	cs.c.sendEvent(protocol.Cont(cs.id, []interface{}{"event", e}))
+}
+
+func (c *connection) busKey() string {
+	return "client/" + strconv.FormatUint(c.id, 10)
+}
+
+// subscribeEvents subscribes client to events of its camera, camera events are sent when types are empty
+func (c *connection) subscribeEvents(id int, params []event.Type) *rpcError {
+	types := make(map[event.Type]bool)
+	for _, t := range params {
+		if !t.Valid() {
+			return errInvalidParams
+		}
+		types[t] = true
+	}
+
+	if len(types) == 0 {
+		for _, t := range event.CameraTypes {
+			types[t] = true
+		}
+	}
+
+	camera := c.server.name
+	c.proxy.bus.Subscribe(c.busKey(), clientSink{c: c, id: id}, func(e event.Event) bool {
+		return e.Camera == camera && types[e.Type]
+	})
+
+	return nil
+}
+
+func (c *connection) unsubscribeEvents() {
+	c.proxy.bus.Unsubscribe(c.busKey())
+}
@@ -1,10 +1,14 @@
+//go:build !nocodec
+
 // c part of decoder/encoder
 
 extern "C"
 {
     #include "codec.h"
     #include <libavcodec/avcodec.h>
+    #include <libavutil/opt.h>
     #include <libavutil/rational.h>
+    #include <libswscale/swscale.h>
 }
 
 #include <pthread.h>
@@ -18,10 +22,19 @@ public:
     void OnStreamStop();
     bool OnVideoPacket(unsigned char* data, size_t size);
 
-    Packet* EncodeFrame();
+    Packet* EncodeFrame(int width, int quality);
     void ResetEncoder(Packet* packet);
 
+    void StartH264(int bitrate);
+    void StopH264();
+    void RequestKeyFrame();
+    Packet* EncodeH264(int64_t pts);
+    void H264Size(int* width, int* height);
+
 private:
+    AVFrame* ConvertFrame(AVFrame* frame, int width, int height, AVPixelFormat fmt);
+    bool OpenH264(int width, int height);
+
     const AVCodec* videoCodec;
     AVCodecContext* videoCodecCtx;
     AVFrame* videoFrame;
@@ -32,6 +45,15 @@ private:
     AVPacket* pkt;
 
     pthread_mutex_t videoMutex;
+
+    // h264 encoder is opened on first frame after start
+    const AVCodec* h264Codec;
+    AVCodecContext* h264CodecCtx;
+    bool h264Enabled;
+    bool h264KeyFrame;
+    int h264Bitrate;
+
+    pthread_mutex_t h264Mutex;
 };
 
 extern "C" void* create()
@@ -59,9 +81,9 @@ extern "C" int onVideoPacket(void* codec, unsigned char* data, size_t size)
     return ((Codec*)codec)->OnVideoPacket(data, size) ? 0 : -1;
 }
 
-extern "C" Packet* encodeFrame(void* codec)
+extern "C" Packet* encodeFrame(void* codec, int width, int quality)
 {
-    return ((Codec*)codec)->EncodeFrame();
+    return ((Codec*)codec)->EncodeFrame(width, quality);
 }
 
 extern "C" void resetEncoder(void* codec, Packet* packet)
@@ -69,6 +91,31 @@ extern "C" void resetEncoder(void* codec, Packet* packet)
     ((Codec*)codec)->ResetEncoder(packet);
 }
 
+extern "C" void startH264(void* codec, int bitrate)
+{
+    ((Codec*)codec)->StartH264(bitrate);
+}
+
+extern "C" void stopH264(void* codec)
+{
+    ((Codec*)codec)->StopH264();
+}
+
+extern "C" void requestKeyFrame(void* codec)
+{
+    ((Codec*)codec)->RequestKeyFrame();
+}
+
+extern "C" Packet* encodeH264(void* codec, int64_t pts)
+{
+    return ((Codec*)codec)->EncodeH264(pts);
+}
+
+extern "C" void h264Size(void* codec, int* width, int* height)
+{
+    ((Codec*)codec)->H264Size(width, height);
+}
+
 
 Codec::Codec()
 {
@@ -82,6 +129,14 @@ Codec::Codec()
     jpegCodec = avcodec_find_encoder(AV_CODEC_ID_MJPEG);
 
     pkt = av_packet_alloc();
+
+    pthread_mutex_init(&h264Mutex, nullptr);
+
+    h264Codec = avcodec_find_encoder(AV_CODEC_ID_H264);
+    h264CodecCtx = nullptr;
+    h264Enabled = false;
+    h264KeyFrame = false;
+    h264Bitrate = 0;
 }
 
 Codec::~Codec()
@@ -92,7 +147,10 @@ Codec::~Codec()
     av_frame_free(&videoFrame);
     av_frame_free(&videoWorkFrame);
 
+    avcodec_free_context(&h264CodecCtx);
+
     pthread_mutex_destroy(&videoMutex);
+    pthread_mutex_destroy(&h264Mutex);
 }
 
 void Codec::OnStreamStart()
@@ -142,27 +200,51 @@ bool Codec::OnVideoPacket(unsigned char* data, size_t size)
     return ok;
 }
 
-Packet* Codec::EncodeFrame()
+Packet* Codec::EncodeFrame(int width, int quality)
 {
     AVCodecContext* jpegCodecCtx = avcodec_alloc_context3(jpegCodec);
 
     Packet* p = new Packet();
     p->data = nullptr;
     p->size = 0;
+    p->keyFrame = 0;
     p->pkt = av_packet_alloc();
 
     pthread_mutex_lock(&videoMutex);
 
     if ((videoFrame->width > 0) && (videoFrame->height > 0)) {
+        // new reference, so we may change frame properties
+        AVFrame* frame = av_frame_clone(videoFrame);
+
+        // we're only scaling down
+        if ((width > 0) && (width < frame->width)) {
+            // keep aspect ratio, chroma subsampling needs even dimensions
+            int height = (int)((int64_t)frame->height * width / frame->width) & ~1;
+            AVFrame* scaled = ConvertFrame(frame, width & ~1, height, (AVPixelFormat)frame->format);
+            if (scaled) {
+                av_frame_free(&frame);
+                frame = scaled;
+            }
+        }
+
         jpegCodecCtx->pix_fmt = videoCodecCtx->pix_fmt;
-        jpegCodecCtx->width = videoFrame->width;
-        jpegCodecCtx->height = videoFrame->height;
+        jpegCodecCtx->width = frame->width;
+        jpegCodecCtx->height = frame->height;
         jpegCodecCtx->time_base = (AVRational){1,2};
 
+        if (quality > 0) {
+            // jpeg quality 1..100 is mapped to mjpeg qscale 31..2
+            int qscale = 31 - (quality - 1) * 29 / 99;
+            jpegCodecCtx->flags |= AV_CODEC_FLAG_QSCALE;
+            jpegCodecCtx->global_quality = FF_QP2LAMBDA * qscale;
+            frame->quality = jpegCodecCtx->global_quality;
+        }
+
         avcodec_open2(jpegCodecCtx, jpegCodec, nullptr);
 
-        int gotFrame;
-        avcodec_send_frame(jpegCodecCtx, videoFrame);
+        avcodec_send_frame(jpegCodecCtx, frame);
+
+        av_frame_free(&frame);
     }
 
     pthread_mutex_unlock(&videoMutex);
@@ -177,8 +259,172 @@ Packet* Codec::EncodeFrame()
     return p;
 }
 
+AVFrame* Codec::ConvertFrame(AVFrame* frame, int width, int height, AVPixelFormat fmt)
+{
+    if ((width <= 0) || (height <= 0))
+        return nullptr;
+
+    if ((frame->width == width) && (frame->height == height) && (frame->format == fmt))
+        return av_frame_clone(frame);
+
+    SwsContext* sws = sws_getContext(
+        frame->width, frame->height, (AVPixelFormat)frame->format,
+        width, height, fmt,
+        SWS_BICUBIC, nullptr, nullptr, nullptr
+    );
+
+    if (!sws)
+        return nullptr;
+
+    AVFrame* converted = av_frame_alloc();
+    converted->format = fmt;
+    converted->width = width;
+    converted->height = height;
+
+    if (av_frame_get_buffer(converted, 0) < 0) {
+        av_frame_free(&converted);
+        sws_freeContext(sws);
+        return nullptr;
+    }
+
+    sws_scale(sws, frame->data, frame->linesize, 0, frame->height, converted->data, converted->linesize);
+    sws_freeContext(sws);
+
+    return converted;
+}
+
 void Codec::ResetEncoder(Packet* p)
 {
     av_packet_free(&p->pkt);
     delete p;
 }
+
+void Codec::StartH264(int bitrate)
+{
+    pthread_mutex_lock(&h264Mutex);
+
+    h264Enabled = true;
+    h264KeyFrame = true;
+
+    // new bitrate is applied on next encoder start
+    if (h264Bitrate != bitrate) {
+        h264Bitrate = bitrate;
+        avcodec_free_context(&h264CodecCtx);
+    }
+
+    pthread_mutex_unlock(&h264Mutex);
+}
+
+void Codec::StopH264()
+{
+    pthread_mutex_lock(&h264Mutex);
+
+    h264Enabled = false;
+    avcodec_free_context(&h264CodecCtx);
+
+    pthread_mutex_unlock(&h264Mutex);
+}
+
+void Codec::RequestKeyFrame()
+{
+    pthread_mutex_lock(&h264Mutex);
+    h264KeyFrame = true;
+    pthread_mutex_unlock(&h264Mutex);
+}
+
+bool Codec::OpenH264(int width, int height)
+{
+    if (!h264Codec)
+        return false;
+
+    h264CodecCtx = avcodec_alloc_context3(h264Codec);
+    h264CodecCtx->pix_fmt = AV_PIX_FMT_YUV420P;
+    h264CodecCtx->width = width;
+    h264CodecCtx->height = height;
+    // pts is in rtp clock units
+    h264CodecCtx->time_base = (AVRational){1,90000};
+    h264CodecCtx->bit_rate = h264Bitrate;
+    h264CodecCtx->gop_size = 50;
+    h264CodecCtx->max_b_frames = 0;
+
+    // options are supported by libx264 only, other encoders will just ignore them
+    av_opt_set(h264CodecCtx->priv_data, "preset", "veryfast", 0);
+    av_opt_set(h264CodecCtx->priv_data, "tune", "zerolatency", 0);
+    av_opt_set(h264CodecCtx->priv_data, "forced-idr", "1", 0);
+
+    if (avcodec_open2(h264CodecCtx, h264Codec, nullptr) < 0) {
+        avcodec_free_context(&h264CodecCtx);
+        return false;
+    }
+
+    return true;
+}
+
+Packet* Codec::EncodeH264(int64_t pts)
+{
+    Packet* p = new Packet();
+    p->data = nullptr;
+    p->size = 0;
+    p->keyFrame = 0;
+    p->pkt = av_packet_alloc();
+
+    pthread_mutex_lock(&h264Mutex);
+
+    AVFrame* frame = nullptr;
+
+    if (h264Enabled) {
+        pthread_mutex_lock(&videoMutex);
+        if ((videoFrame->width > 0) && (videoFrame->height > 0))
+            frame = av_frame_clone(videoFrame);
+        pthread_mutex_unlock(&videoMutex);
+    }
+
+    if (frame) {
+        // encoder needs even dimensions
+        int width = frame->width & ~1;
+        int height = frame->height & ~1;
+
+        // picture size may be changed after camera reconnect
+        if (h264CodecCtx && ((h264CodecCtx->width != width) || (h264CodecCtx->height != height))) {
+            avcodec_free_context(&h264CodecCtx);
+            h264KeyFrame = true;
+        }
+
+        if (h264CodecCtx || OpenH264(width, height)) {
+            AVFrame* converted = ConvertFrame(frame, width, height, h264CodecCtx->pix_fmt);
+            if (converted) {
+                converted->pts = pts;
+                converted->pict_type = AV_PICTURE_TYPE_NONE;
+
+                if (h264KeyFrame) {
+                    converted->pict_type = AV_PICTURE_TYPE_I;
+                    h264KeyFrame = false;
+                }
+
+                if ((avcodec_send_frame(h264CodecCtx, converted) >= 0) && (avcodec_receive_packet(h264CodecCtx, p->pkt) >= 0)) {
+                    p->data = p->pkt->data;
+                    p->size = p->pkt->size;
+                    p->keyFrame = (p->pkt->flags & AV_PKT_FLAG_KEY) ? 1 : 0;
+                }
+
+                av_frame_free(&converted);
+            }
+        }
+
+        av_frame_free(&frame);
+    }
+
+    pthread_mutex_unlock(&h264Mutex);
+
+    return p;
+}
+
+void Codec::H264Size(int* width, int* height)
+{
+    pthread_mutex_lock(&h264Mutex);
+
+    *width = h264CodecCtx ? h264CodecCtx->width : 0;
+    *height = h264CodecCtx ? h264CodecCtx->height : 0;
+
+    pthread_mutex_unlock(&h264Mutex);
+}
@@ -1,10 +1,15 @@
+//go:build !nocodec
+
 package codec
 
-// #cgo pkg-config: libavutil libavcodec
+// #cgo pkg-config: libavutil libavcodec libswscale
 // #include "codec.h"
 import "C"
 import "unsafe"
 
+// Enabled is false when proxy is built without codec
+const Enabled = true
+
 type Codec struct {
 	codec unsafe.Pointer
 }
@@ -29,10 +34,17 @@ func (c *Codec) OnVideoPacket(data []byte) bool {
 	return C.onVideoPacket(c.codec, (*C.uchar)(unsafe.Pointer(&data[0])), C.size_t(len(data))) == 0
 }
 
+// EncodeFrame encodes last decoded frame to jpeg
 func (c *Codec) EncodeFrame() []byte {
+	return c.EncodeJpeg(0, 0)
+}
+
+// EncodeJpeg encodes last decoded frame to jpeg scaled down to width,
+// zero width means original size and zero quality means encoder default
+func (c *Codec) EncodeJpeg(width int, quality int) []byte {
 	var data []byte
 
-	pkt := C.encodeFrame(c.codec)
+	pkt := C.encodeFrame(c.codec, C.int(width), C.int(quality))
 	if pkt.size > 0 {
 		data = C.GoBytes(unsafe.Pointer(pkt.data), C.int(pkt.size))
 	}
@@ -41,3 +53,41 @@ func (c *Codec) EncodeFrame() []byte {
 
 	return data
 }
+
+// StartH264 enables h264 encoding of decoded frames, bitrate is in bits per second
+func (c *Codec) StartH264(bitrate int) {
+	C.startH264(c.codec, C.int(bitrate))
+}
+
+func (c *Codec) StopH264() {
+	C.stopH264(c.codec)
+}
+
+// RequestKeyFrame forces next encoded h264 frame to be a key frame
+func (c *Codec) RequestKeyFrame() {
+	C.requestKeyFrame(c.codec)
+}
+
+// EncodeH264 encodes last decoded frame with pts in 90kHz units,
+// returns annex b access unit and key frame flag
+func (c *Codec) EncodeH264(pts int64) ([]byte, bool) {
+	var data []byte
+
+	pkt := C.encodeH264(c.codec, C.int64_t(pts))
+	if pkt.size > 0 {
+		data = C.GoBytes(unsafe.Pointer(pkt.data), C.int(pkt.size))
+	}
+	key := pkt.keyFrame != 0
+
+	C.resetEncoder(c.codec, pkt)
+
+	return data, key
+}
+
+// H264Size returns picture size of h264 encoder
+func (c *Codec) H264Size() (int, int) {
+	var width, height C.int
+	C.h264Size(c.codec, &width, &height)
+
+	return int(width), int(height)
+}
@@ -5,6 +5,7 @@ typedef struct
 {
     unsigned char* data;
     size_t size;
+    int keyFrame;
     AVPacket *pkt;
 } Packet;
 
@@ -13,5 +14,10 @@ void destroy(void* codec);
 void onStreamStart(void* codec);
 void onStreamStop(void* codec);
 int onVideoPacket(void* codec, unsigned char* data, size_t size);
-Packet* encodeFrame(void* codec);
+Packet* encodeFrame(void* codec, int width, int quality);
 void resetEncoder(void* codec, Packet* packet);
+void startH264(void* codec, int bitrate);
+void stopH264(void* codec);
+void requestKeyFrame(void* codec);
+Packet* encodeH264(void* codec, int64_t pts);
+void h264Size(void* codec, int* width, int* height);
@@ -0,0 +1,52 @@
+//go:build nocodec
+
+package codec
+
+// Enabled is false when proxy is built without codec
+const Enabled = false
+
+// Codec is a stub for builds without cgo and libavcodec,
+// frames are never decoded and encoding methods return no data.
+type Codec struct{}
+
+func Create() *Codec {
+	return &Codec{}
+}
+
+func (c *Codec) Destroy() {
+}
+
+func (c *Codec) OnStreamStart() {
+}
+
+func (c *Codec) OnStreamStop() {
+}
+
+func (c *Codec) OnVideoPacket(_ []byte) bool {
+	return true
+}
+
+func (c *Codec) EncodeFrame() []byte {
+	return nil
+}
+
+func (c *Codec) EncodeJpeg(_ int, _ int) []byte {
+	return nil
+}
+
+func (c *Codec) StartH264(_ int) {
+}
+
+func (c *Codec) StopH264() {
+}
+
+func (c *Codec) RequestKeyFrame() {
+}
+
+func (c *Codec) EncodeH264(_ int64) ([]byte, bool) {
+	return nil, false
+}
+
+func (c *Codec) H264Size() (int, int) {
+	return 0, 0
+}
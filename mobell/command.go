@@ -0,0 +1,68 @@
+package mobell
+
+import (
+	"context"
+	"errors"
+	"mobell-proxy/mobell/mxpeg"
+	"mobell-proxy/mobell/protocol"
+	"time"
+)
+
+// max time to wait for camera response to client command
+const cameraCmdTimeout = time.Second * 10
+
+// delay between device registration attempts
+const registerRetryInterval = time.Second * 5
+
+var (
+	errCameraOffline = &rpcError{Code: -32002, Message: "camera is not connected"}
+	errCameraTimeout = &rpcError{Code: -32003, Message: "camera response timeout"}
+)
+
+// cmdDone receives camera result or error, err is nil on success
+type cmdDone func(result interface{}, err interface{})
+
+// cameraCmd sends command to camera, done is called exactly once with camera response or timeout error.
+// Command is sent without waiting for response when done is nil.
+func (s *Server) cameraCmd(method string, params interface{}, done cmdDone) {
+	if done == nil {
+		s.client.SendCmdSilent(method, params)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(s.runCtx, cameraCmdTimeout)
+		defer cancel()
+
+		m, err := s.client.Call(ctx, method, params)
+
+		var cmdErr *mxpeg.CmdError
+		switch {
+		case err == nil:
+			done(m.Result, nil)
+		case errors.As(err, &cmdErr):
+			done(nil, cmdErr.Err)
+		case errors.Is(err, context.DeadlineExceeded):
+			s.log.WithField("method", method).Warn("camera command timed out")
+			done(nil, errCameraTimeout)
+		default:
+			done(nil, errCameraOffline)
+		}
+	}()
+}
+
+// logCmdError returns cmdDone which logs camera errors, it is used for commands without client
+func (s *Server) logCmdError(method string) cmdDone {
+	return func(_ interface{}, err interface{}) {
+		if err != nil {
+			s.log.WithField("method", method).WithField("error", err).Warn("camera command failed")
+		}
+	}
+}
+
+// respond returns cmdDone which sends camera response to client request
+func (c *connection) respond(id int) cmdDone {
+	return func(result interface{}, err interface{}) {
+		c.sendEvent(protocol.Response{Id: id, Result: result, Error: err})
+	}
+}
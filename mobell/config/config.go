@@ -0,0 +1,526 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrNoCameras = errors.New("no cameras configured")
+
+const DefaultCamera = "default"
+
+type Camera struct {
+	Name string `yaml:"name"`
+	// optional dedicated listen address for this camera
+	Listen string `yaml:"listen"`
+
+	Addr     string `yaml:"addr"`
+	User     string `yaml:"user"`
+	Pass     string `yaml:"pass"`
+	PassFile string `yaml:"pass_file"`
+	PassEnv  string `yaml:"pass_env"`
+	// camera authentication: auto, digest or basic
+	Auth string `yaml:"auth"`
+	// bell buttons to register, all addressees are registered when empty
+	Addressees []int `yaml:"addressees"`
+	// allowed trigger outputs, only door is allowed when empty
+	Outputs []Output `yaml:"outputs"`
+}
+
+// DoorOutput is triggered on door opening
+const DoorOutput = "door"
+
+// Output is a camera trigger output, i.e. door, gate or light relay
+type Output struct {
+	Name string `yaml:"name"`
+	// role required for triggering, full by default
+	Role string `yaml:"role"`
+}
+
+var Roles = []string{"view", "talk", "full", "admin"}
+
+type User struct {
+	Name string `yaml:"name"`
+	// htdigest compatible hash: md5(name:realm:password), may be empty for client certificate only users
+	Hash string `yaml:"hash"`
+	// one of view, talk, full and admin, default role is used when empty
+	Role string `yaml:"role"`
+}
+
+type Auth struct {
+	Realm string `yaml:"realm"`
+	Users []User `yaml:"users"`
+	// role for users without explicit role and for client certificate users not in the list
+	DefaultRole string `yaml:"default_role"`
+}
+
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// optional ca for client certificates verification
+	ClientCA           string `yaml:"client_ca"`
+	ClientCertRequired bool   `yaml:"client_cert_required"`
+}
+
+func (t *TLS) Enabled() bool {
+	return t.Cert != ""
+}
+
+type HTTP struct {
+	// listen address for metrics and other http endpoints, disabled when empty
+	Listen string `yaml:"listen"`
+	// max frame rate for mjpeg stream
+	MjpegFps int `yaml:"mjpeg_fps"`
+}
+
+type RTSP struct {
+	// listen address for rtsp server, disabled when empty
+	Listen string `yaml:"listen"`
+}
+
+type HLS struct {
+	// target segment duration, segments are cut on key frames
+	SegmentDuration time.Duration `yaml:"segment_duration"`
+	// number of segments in playlist
+	Segments int `yaml:"segments"`
+	// encoding is stopped when there are no requests during this interval
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// H264 is a transcoder settings for rtsp and hls
+type H264 struct {
+	// bitrate in kbit/s
+	Bitrate int `yaml:"bitrate"`
+}
+
+type Recording struct {
+	// directory for clips, recording is disabled when empty
+	Dir string `yaml:"dir"`
+	// clip starts this time before the ring
+	PreRoll time.Duration `yaml:"pre_roll"`
+	// clip ends this time after the ring
+	PostRoll time.Duration `yaml:"post_roll"`
+	// clip ends this time after bell is answered or door is opened
+	Tail        time.Duration `yaml:"tail"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// convert clips to mp4 with ffmpeg
+	Mp4     bool   `yaml:"mp4"`
+	Ffmpeg  string `yaml:"ffmpeg"`
+	KeepMxg bool   `yaml:"keep_mxg"`
+	// retention, zero means no limit
+	MaxAge time.Duration `yaml:"max_age"`
+	// max size of all clips in megabytes
+	MaxSize int64 `yaml:"max_size"`
+}
+
+// CameraEvents maps camera event names to event types, event type is disabled when list is empty
+type CameraEvents struct {
+	Motion []string `yaml:"motion"`
+	Access []string `yaml:"access"`
+	Tamper []string `yaml:"tamper"`
+	Input  []string `yaml:"input"`
+}
+
+// Passthrough controls forwarding of unknown client methods to camera
+type Passthrough struct {
+	// allowed methods, all methods are allowed when empty
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// role required for forwarded methods
+	Role string `yaml:"role"`
+}
+
+type History struct {
+	// bolt database file, history is disabled when empty
+	Path string `yaml:"path"`
+	// events older than this are removed, zero means no limit
+	MaxAge time.Duration `yaml:"max_age"`
+	// events to store, all events are stored when empty
+	Events []string `yaml:"events"`
+}
+
+type Webhook struct {
+	URL string `yaml:"url"`
+	// events to send, all events are sent when empty
+	Events []string `yaml:"events"`
+	// text/template for request body, json encoded event is sent when empty
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+	// hmac-sha256 signature key
+	Secret     string        `yaml:"secret"`
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+type MQTT struct {
+	// broker url, i.e. tcp://127.0.0.1:1883, bridge is disabled when empty
+	Broker   string `yaml:"broker"`
+	ClientId string `yaml:"client_id"`
+	User     string `yaml:"user"`
+	Pass     string `yaml:"pass"`
+	PassFile string `yaml:"pass_file"`
+	PassEnv  string `yaml:"pass_env"`
+	// topics prefix
+	Prefix string `yaml:"prefix"`
+	// home assistant discovery
+	Discovery       bool   `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+type Config struct {
+	Listen    string `yaml:"listen"`
+	Iface     string `yaml:"iface"`
+	KeepAlive int    `yaml:"keepalive"`
+	LogLevel  string `yaml:"log_level"`
+	// ringing is cleared after this timeout when camera doesn't send bell stop
+	RingTimeout time.Duration `yaml:"ring_timeout"`
+
+	// client authentication, disabled when there are no users
+	Auth Auth `yaml:"auth"`
+	// tls for client listeners, disabled when there is no certificate
+	TLS TLS `yaml:"tls"`
+
+	HTTP HTTP `yaml:"http"`
+
+	RTSP RTSP `yaml:"rtsp"`
+	HLS  HLS  `yaml:"hls"`
+	H264 H264 `yaml:"h264"`
+
+	Recording Recording `yaml:"recording"`
+
+	History History `yaml:"history"`
+
+	Passthrough Passthrough `yaml:"passthrough"`
+
+	CameraEvents CameraEvents `yaml:"camera_events"`
+
+	Webhooks []Webhook `yaml:"webhooks"`
+
+	MQTT MQTT `yaml:"mqtt"`
+
+	// single camera setup, it is the same as camera with name 'default' in cameras list
+	Camera  Camera   `yaml:"camera"`
+	Cameras []Camera `yaml:"cameras"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:      ":8080",
+		KeepAlive:   90,
+		RingTimeout: time.Minute * 2,
+		HTTP: HTTP{
+			MjpegFps: 5,
+		},
+		HLS: HLS{
+			SegmentDuration: time.Second * 2,
+			Segments:        6,
+			IdleTimeout:     time.Second * 30,
+		},
+		H264: H264{
+			Bitrate: 2048,
+		},
+		Recording: Recording{
+			PreRoll:     time.Second * 5,
+			PostRoll:    time.Second * 30,
+			Tail:        time.Second * 10,
+			MaxDuration: time.Minute * 5,
+			Ffmpeg:      "ffmpeg",
+		},
+		History: History{
+			MaxAge: time.Hour * 24 * 30,
+		},
+		Passthrough: Passthrough{
+			Role: "full",
+		},
+		CameraEvents: CameraEvents{
+			Motion: []string{"motion", "vm"},
+			Access: []string{"access", "keypad", "rfid"},
+			Tamper: []string{"tamper"},
+			Input:  []string{"input", "signal"},
+		},
+		Auth: Auth{
+			Realm:       "mobell",
+			DefaultRole: "view",
+		},
+		MQTT: MQTT{
+			ClientId:        "mobell-proxy",
+			Prefix:          "mobell",
+			DiscoveryPrefix: "homeassistant",
+		},
+	}
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Resolve checks config and loads secrets from files and environment
+func (c *Config) Resolve() error {
+	if c.Camera.Addr != "" {
+		cam := c.Camera
+		if cam.Name == "" {
+			cam.Name = DefaultCamera
+		}
+		c.Cameras = append([]Camera{cam}, c.Cameras...)
+		c.Camera = Camera{}
+	}
+
+	if len(c.Cameras) == 0 {
+		return ErrNoCameras
+	}
+
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = Default().KeepAlive
+	}
+
+	if c.RingTimeout <= 0 {
+		c.RingTimeout = Default().RingTimeout
+	}
+
+	if c.HTTP.MjpegFps <= 0 {
+		c.HTTP.MjpegFps = Default().HTTP.MjpegFps
+	}
+
+	if c.H264.Bitrate <= 0 {
+		c.H264.Bitrate = Default().H264.Bitrate
+	}
+
+	if c.HLS.SegmentDuration <= 0 {
+		c.HLS.SegmentDuration = Default().HLS.SegmentDuration
+	}
+
+	if c.HLS.Segments <= 0 {
+		c.HLS.Segments = Default().HLS.Segments
+	}
+
+	if c.HLS.IdleTimeout <= 0 {
+		c.HLS.IdleTimeout = Default().HLS.IdleTimeout
+	}
+
+	if c.History.MaxAge < 0 {
+		return errors.New("history max_age can't be negative")
+	}
+
+	if err := c.Recording.check(); err != nil {
+		return err
+	}
+
+	if err := c.Auth.check(); err != nil {
+		return err
+	}
+
+	if c.Passthrough.Role == "" {
+		c.Passthrough.Role = Default().Passthrough.Role
+	}
+
+	if !validRole(c.Passthrough.Role) {
+		return fmt.Errorf("invalid passthrough role '%s'", c.Passthrough.Role)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("both tls certificate and key should be provided")
+	}
+
+	if c.TLS.ClientCA != "" && !c.TLS.Enabled() {
+		return errors.New("tls client ca requires tls certificate")
+	}
+
+	for i := range c.Webhooks {
+		w := &c.Webhooks[i]
+
+		if w.URL == "" {
+			return errors.New("webhook url is not provided")
+		}
+
+		if w.Retries < 0 {
+			w.Retries = 0
+		}
+
+		if w.RetryDelay <= 0 {
+			w.RetryDelay = time.Second
+		}
+
+		if w.Timeout <= 0 {
+			w.Timeout = time.Second * 10
+		}
+	}
+
+	mqttPass, err := secret(c.MQTT.Pass, c.MQTT.PassFile, c.MQTT.PassEnv)
+	if err != nil {
+		return fmt.Errorf("mqtt: %w", err)
+	}
+
+	c.MQTT.Pass = mqttPass
+	c.MQTT.PassFile = ""
+	c.MQTT.PassEnv = ""
+
+	names := make(map[string]bool)
+
+	for i := range c.Cameras {
+		cam := &c.Cameras[i]
+
+		if cam.Name == "" || strings.Contains(cam.Name, "/") {
+			return fmt.Errorf("invalid camera name '%s'", cam.Name)
+		}
+
+		if names[cam.Name] {
+			return fmt.Errorf("duplicate camera name '%s'", cam.Name)
+		}
+		names[cam.Name] = true
+
+		if cam.Addr == "" {
+			return fmt.Errorf("address is not provided for camera '%s'", cam.Name)
+		}
+
+		pass, err := secret(cam.Pass, cam.PassFile, cam.PassEnv)
+		if err != nil {
+			return fmt.Errorf("camera '%s': %w", cam.Name, err)
+		}
+
+		cam.Pass = pass
+		cam.PassFile = ""
+		cam.PassEnv = ""
+
+		if cam.Auth == "" {
+			cam.Auth = "auto"
+		}
+		if cam.Auth != "auto" && cam.Auth != "digest" && cam.Auth != "basic" {
+			return fmt.Errorf("invalid auth '%s' for camera '%s'", cam.Auth, cam.Name)
+		}
+
+		if err := cam.checkOutputs(); err != nil {
+			return fmt.Errorf("camera '%s': %w", cam.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// secret returns value from file or environment variable if they are provided
+func secret(value string, file string, env string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading password file: %w", err)
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if env != "" {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+
+		return v, nil
+	}
+
+	return value, nil
+}
+
+func (a *Auth) check() error {
+	if !validRole(a.DefaultRole) {
+		return fmt.Errorf("invalid default role '%s'", a.DefaultRole)
+	}
+
+	names := make(map[string]bool)
+
+	for _, u := range a.Users {
+		if u.Name == "" || strings.Contains(u.Name, ":") {
+			return fmt.Errorf("invalid user name '%s'", u.Name)
+		}
+
+		if names[u.Name] {
+			return fmt.Errorf("duplicate user '%s'", u.Name)
+		}
+		names[u.Name] = true
+
+		if _, err := hex.DecodeString(u.Hash); err != nil || (u.Hash != "" && len(u.Hash) != 32) {
+			return fmt.Errorf("invalid password hash for user '%s'", u.Name)
+		}
+
+		if u.Role != "" && !validRole(u.Role) {
+			return fmt.Errorf("invalid role '%s' for user '%s'", u.Role, u.Name)
+		}
+	}
+
+	return nil
+}
+
+func (c *Camera) checkOutputs() error {
+	if len(c.Outputs) == 0 {
+		c.Outputs = []Output{{Name: DoorOutput}}
+	}
+
+	names := make(map[string]bool)
+
+	for i := range c.Outputs {
+		o := &c.Outputs[i]
+
+		if o.Name == "" {
+			return errors.New("output name is not provided")
+		}
+
+		if names[o.Name] {
+			return fmt.Errorf("duplicate output '%s'", o.Name)
+		}
+		names[o.Name] = true
+
+		if o.Role == "" {
+			o.Role = "full"
+		}
+
+		if !validRole(o.Role) {
+			return fmt.Errorf("invalid role '%s' for output '%s'", o.Role, o.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r *Recording) check() error {
+	if r.PreRoll < 0 || r.PostRoll < 0 || r.Tail < 0 || r.MaxDuration < 0 || r.MaxAge < 0 || r.MaxSize < 0 {
+		return errors.New("recording durations and sizes can't be negative")
+	}
+
+	if r.MaxDuration == 0 {
+		r.MaxDuration = Default().Recording.MaxDuration
+	}
+
+	if r.Ffmpeg == "" {
+		r.Ffmpeg = Default().Recording.Ffmpeg
+	}
+
+	return nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,105 +2,154 @@ package mobell
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"github.com/apex/log"
+	"mobell-proxy/mobell/auth"
+	"mobell-proxy/mobell/event"
 	"mobell-proxy/mobell/mxpeg"
+	"mobell-proxy/mobell/protocol"
 	"mobell-proxy/mobell/stream"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// last connection id
+var connectionId uint64
+
 type connection struct {
+	id     uint64
+	proxy  *Proxy
+	router router
 	server *Server
 
 	rb  *mxpeg.RingBuffer
 	str *stream.Stream
+	tls *tls.Conn
+
+	user       string
+	remoteAddr string
+	bytesSent  uint64
 
 	videoEnabled bool
 	bellEvtId    int
-
-	keepAliveSec int
+	// subscribed bell buttons, nil means all buttons
+	addressees map[int]bool
 
 	log log.Interface
 }
 
-func handleConnection(ctx context.Context, conn net.Conn, server *Server) {
-	l := log.WithField("ctx", conn.RemoteAddr().String())
+type request struct {
+	method string
+	uri    string
+	path   string
+	query  string
+	header map[string]string
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, p *Proxy, r router) {
+	addr := conn.RemoteAddr().String()
+	l := log.WithField("ctx", addr)
 
 	str := stream.NewStream(ctx, conn, l)
 	str.ReadTimeout = time.Second * 180
 
 	c := &connection{
-		server:       server,
-		rb:           mxpeg.NewRingBuffer(256*1024, str, l),
-		str:          str,
-		log:          l,
-		keepAliveSec: server.keepAliveSec,
+		id:         atomic.AddUint64(&connectionId, 1),
+		proxy:      p,
+		router:     r,
+		rb:         mxpeg.NewRingBuffer(256*1024, str, l),
+		str:        str,
+		remoteAddr: addr,
+		log:        l,
 	}
+	c.tls, _ = conn.(*tls.Conn)
+
 	go c.run()
 }
 
+func (c *connection) role() role {
+	return c.proxy.userRole(c.user)
+}
+
 func (c *connection) send(data []byte) {
 	_, _ = c.str.Write(data)
+	atomic.AddUint64(&c.bytesSent, uint64(len(data)))
+}
+
+// reply sends http response and closes connection
+func (c *connection) reply(resp string) {
+	c.send([]byte(resp))
+	c.str.Finish()
 }
 
-func (c *connection) sendEvent(evt map[string]interface{}) {
-	b, err := json.Marshal(evt)
+// sendEvent sends protocol message in APP12 segment
+func (c *connection) sendEvent(msg interface{}) {
+	data, err := protocol.EncodeApp12(msg)
 	if err != nil {
-		c.log.WithError(err).Error("error marshalling event")
+		c.log.WithError(err).Error("error encoding event")
 		return
 	}
 
-	c.log.WithField("evt", string(b)).Debug("sending client event")
-
-	l := len(b) + 2
-
-	data := make([]byte, l+2)
-
-	data[0] = 0xff
-	data[1] = 0xec
-	data[2] = (byte)(l >> 8)
-	data[3] = (byte)(l)
-	copy(data[4:], b)
+	c.log.WithField("evt", string(data[4:])).Debug("sending client event")
 
 	c.send(data)
 }
 
-func (c *connection) sendBell(isRing bool) {
-	if c.bellEvtId > 0 {
-		c.sendEvent(map[string]interface{}{
-			"result": []interface{}{"bell", isRing, !isRing, []interface{}{1, "Main Bell", ""}},
-			"type":   "cont",
-			"error":  nil,
-			"id":     c.bellEvtId,
-		})
+func (c *connection) sendBell(isRing bool, a *addressee) {
+	if c.bellEvtId > 0 && (c.addressees == nil || c.addressees[a.Id]) {
+		c.sendEvent(protocol.Cont(c.bellEvtId, protocol.Bell{Ringing: isRing, Addressee: &a.value}))
 	}
 }
 
 func (c *connection) sendSuppress() {
-	// this is a non-standard event
-	// this event is supported ONLY by mobell application
 	if c.bellEvtId > 0 {
-		c.sendEvent(map[string]interface{}{
-			"result": []interface{}{"suppress"},
-			"type":   "cont",
-			"error":  nil,
-			"id":     c.bellEvtId,
-		})
+		c.sendEvent(protocol.Cont(c.bellEvtId, protocol.DeviceEvent{Name: protocol.EventSuppress}))
 	}
 }
 
 func (c *connection) run() {
+	str := c.str
+
+	rb := mxpeg.NewRingBuffer(16*1024, str, c.log)
+
+	// http part
+	req, err := readRequest(rb)
+	if err != nil {
+		c.log.WithError(err).Error("error reading http request headers")
+		str.Close()
+		return
+	}
+
+	if !c.authenticate(req) {
+		return
+	}
+
+	server, path := c.router.route(req.path)
+	if server == nil {
+		c.log.WithField("path", req.path).Warn("unknown camera requested")
+		c.reply("HTTP/1.1 404 Not Found\r\n\r\nUnknown camera\r\n")
+		return
+	}
+
+	c.server = server
+	c.log = c.log.WithField("camera", server.name)
+
+	if c.handleCmd(path) {
+		return
+	}
+
+	// send status
+	c.send([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
 	c.server.addConnection(c)
 
 	doneCh := make(chan struct{})
 	updCh := make(chan struct{})
 	go func() {
-		timeout := time.Second * time.Duration(c.keepAliveSec)
-
-		timer := time.NewTimer(timeout)
+		timer := time.NewTimer(c.server.keepAlive())
 		for {
 			select {
 			case _ = <-doneCh:
@@ -110,36 +159,21 @@ func (c *connection) run() {
 				if !timer.Stop() {
 					<-timer.C
 				}
-				timer.Reset(timeout)
+				timer.Reset(c.server.keepAlive())
 			case _ = <-timer.C:
-				c.sendEvent(map[string]interface{}{
-					"method": "ping",
-				})
-				timer.Reset(timeout)
+				c.sendEvent(protocol.Ping)
+				timer.Reset(c.server.keepAlive())
 			}
 		}
 	}()
 
-	str := c.str
-
 	defer func() {
 		close(doneCh)
+		c.unsubscribeEvents()
 		c.server.delConnection(c)
 		str.Close()
 	}()
 
-	rb := mxpeg.NewRingBuffer(16*1024, str, c.log)
-
-	// http part
-	err := c.handleHttp(rb)
-	if err != nil {
-		c.log.WithError(err).Error("error reading http request headers")
-		return
-	}
-
-	// send status
-	c.send([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-
 	for {
 		data, err := readEvt(rb)
 		if err != nil {
@@ -150,6 +184,10 @@ func (c *connection) run() {
 		updCh <- struct{}{}
 
 		if data[0] == 0xff {
+			if !c.role().canTalk() {
+				continue
+			}
+
 			if len(data) == 22 && data[6] == 0x53 {
 				if data[9] == 0x81 {
 					c.server.audioStart(c, data)
@@ -162,57 +200,197 @@ func (c *connection) run() {
 		} else {
 			c.log.WithField("evt", string(data)).Debug("got client event")
 
-			var evt map[string]interface{}
-
-			err := json.Unmarshal(data, &evt)
+			m, err := protocol.Decode(data)
 			if err != nil {
-				c.log.WithError(err).Error("error unmarshal event")
+				c.log.WithError(err).Error("error decoding event")
 				break
 			}
 
-			e := jsonValue{v: evt}
-
-			id := e.mapGet("id").asInt()
-			method := e.mapGet("method").asString()
-			params := e.mapGet("params")
-			c.handleEvt(id, method, params)
+			c.handleEvt(m)
 		}
 	}
 }
 
-func (c *connection) handleEvt(id int, method string, params jsonValue) {
+func (c *connection) handleEvt(m *protocol.Message) {
+	id := m.Id
+
+	if !c.role().allowed(m.Method) {
+		c.log.WithField("method", m.Method).Warn("method is not allowed")
+		c.sendEvent(protocol.Fail(id, errForbidden))
+		return
+	}
+
 	var r interface{} = 0
 
-	switch method {
-	case "live":
+	switch m.Method {
+	case protocol.MethodLive:
 		c.server.enableVideo(c)
-	case "list_addressees":
-		r = [][]interface{}{{1, "MainBell", ""}}
-	case "trigger":
-		// TODO check if param equals to ['door']
-		c.server.openDoor(c)
-	case "bell_ack":
-		isAck := params.arrGet(0).asBool()
-		if isAck {
-			c.server.bellAck(c)
+	case protocol.MethodListAddressees:
+		r = c.server.addresseeList()
+	case protocol.MethodAddDevice:
+		var p protocol.AddDeviceParams
+		if err := m.DecodeParams(&p); err != nil {
+			c.invalidParams(id, err)
+			return
+		}
+		c.server.subscribe(c, p.Addressees)
+	case protocol.MethodTrigger:
+		var p protocol.TriggerParams
+		if err := m.DecodeParams(&p); err != nil {
+			c.invalidParams(id, err)
+			return
+		}
+		// response is sent when camera answers
+		if rpcErr := c.trigger(p.Output, c.respond(id)); rpcErr != nil {
+			c.sendEvent(protocol.Fail(id, rpcErr))
+		}
+		return
+	case protocol.MethodBellAck:
+		var p protocol.BellAckParams
+		if err := m.DecodeParams(&p); err != nil {
+			c.invalidParams(id, err)
+			return
+		}
+		// response is sent when camera answers
+		if p.Ack {
+			c.server.bellAck(c, c.respond(id))
 		} else {
-			c.server.bellReject(c)
+			c.server.bellReject(c, c.respond(id))
 		}
-	case "suppress":
+		return
+	case protocol.MethodSuppress:
 		c.server.bellSupress(c)
-	case "register_device":
+	case protocol.MethodRegisterDevice:
+		// current bell state should be sent after response
+		c.sendEvent(protocol.Result(id, r))
 		c.server.registerBell(c, id)
-	case "pong":
 		return
+	case protocol.MethodSubscribeEvents:
+		// params: [event types], events are sent as continuation of this request
+		var types []event.Type
+		if err := m.DecodeParams(&types); err != nil {
+			c.invalidParams(id, err)
+			return
+		}
+		if rpcErr := c.subscribeEvents(id, types); rpcErr != nil {
+			c.sendEvent(protocol.Fail(id, rpcErr))
+			return
+		}
+	case protocol.MethodPong:
+		return
+	default:
+		c.passthrough(m)
+		return
+	}
+
+	c.sendEvent(protocol.Result(id, r))
+}
+
+// invalidParams reports params decode error to client
+func (c *connection) invalidParams(id int, err error) {
+	c.log.WithError(err).Warn("invalid params")
+	c.sendEvent(protocol.Fail(id, invalidParams(err)))
+}
+
+// trigger validates user role for requested output
+func (c *connection) trigger(name string, done cmdDone) *rpcError {
+	o, ok := c.server.output(name)
+	if !ok {
+		c.log.WithField("output", name).Warn("output is not allowed")
+		return errUnknownOutput
 	}
 
-	c.sendEvent(map[string]interface{}{"result": r, "error": nil, "id": id})
+	if c.role() < roleNames[o.Role] {
+		c.log.WithField("output", name).Warn("output is not allowed for user")
+		return errForbidden
+	}
+
+	_ = c.server.trigger(c, name, done)
+
+	return nil
 }
 
-func (c *connection) handleHttp(rb *mxpeg.RingBuffer) (err error) {
+// authenticate checks client credentials and sends 401 response if they are not valid
+func (c *connection) authenticate(req *request) bool {
+	// verified client certificate is enough
+	if c.tls != nil {
+		st := c.tls.ConnectionState()
+		if user := clientCertUser(&st); user != "" {
+			c.user = user
+			c.log = c.log.WithField("user", user)
+			return true
+		}
+	}
+
+	a := c.proxy.authenticator()
+	if !a.Enabled() {
+		return true
+	}
+
+	user, err := a.Check(req.method, req.uri, req.header["authorization"])
+	if err == nil {
+		c.user = user
+		c.log = c.log.WithField("user", user)
+		return true
+	}
+
+	if err != auth.ErrNoCredentials {
+		c.log.WithError(err).Warn("authentication failed")
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 401 Unauthorized\r\n")
+	for _, h := range a.Challenge(err == auth.ErrStaleNonce) {
+		b.WriteString("WWW-Authenticate: " + h + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+
+	c.reply(b.String())
+
+	return false
+}
+
+// handleCmd handles simple http commands, returns true if path is a command and response was sent
+func (c *connection) handleCmd(path string) bool {
+	var isRing bool
+	switch path {
+	case "/bell":
+		isRing = true
+	case "/nobell":
+		isRing = false
+	default:
+		return false
+	}
+
+	// commands are broadcast to all clients of camera
+	if c.role() < roleFull {
+		c.log.WithField("path", path).Warn("command is not allowed for user")
+		c.reply("HTTP/1.1 403 Forbidden\r\n\r\nForbidden\r\n")
+		return true
+	}
+
+	c.server.sendBell(isRing)
+	c.reply("HTTP/1.1 200 OK\r\n\r\nCommand applied\r\n")
+
+	return true
+}
+
+func readRequest(rb *mxpeg.RingBuffer) (req *request, err error) {
 	defer rb.Recover(&err)
 
-	cmdHandled := false
+	req = &request{header: make(map[string]string)}
+
+	f := strings.Fields(mxpeg.ReadLine(rb))
+	if len(f) < 2 {
+		return nil, errors.New("malformed request line")
+	}
+
+	req.method = f[0]
+	req.uri = f[1]
+	req.path = f[1]
+	if i := strings.IndexByte(req.path, '?'); i >= 0 {
+		req.path, req.query = req.path[:i], req.path[i+1:]
+	}
 
 	for {
 		line := mxpeg.ReadLine(rb)
@@ -220,29 +398,13 @@ func (c *connection) handleHttp(rb *mxpeg.RingBuffer) (err error) {
 			break
 		}
 
-		if strings.HasPrefix(line, "GET ") || strings.HasPrefix(line, "POST ") {
-			verbs := strings.Fields(line)
-			if len(verbs) > 1 {
-				cmd := verbs[1]
-
-				switch cmd {
-				case "/bell":
-					cmdHandled = true
-					c.server.sendBell(true)
-				case "/nobell":
-					cmdHandled = true
-					c.server.sendBell(false)
-				}
-			}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			name := strings.ToLower(strings.TrimSpace(line[:i]))
+			req.header[name] = strings.TrimSpace(line[i+1:])
 		}
 	}
 
-	if cmdHandled {
-		c.send([]byte("HTTP/1.1 200 OK\r\n\r\nCommand applied\r\n"))
-		return errors.New("command applied")
-	}
-
-	return nil
+	return req, nil
 }
 
 func readEvt(rb *mxpeg.RingBuffer) (data []byte, err error) {
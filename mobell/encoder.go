@@ -0,0 +1,73 @@
+package mobell
+
+import (
+	"time"
+)
+
+// h264ClockRate is a clock rate for h264 timestamps, it is the same for rtp and fmp4
+const h264ClockRate = 90000
+
+// h264Source runs h264 encoder in server loop, so codec is never used after destroying.
+// Encoder is running while it is used by at least one stream.
+type h264Source struct {
+	s *Server
+}
+
+func (src h264Source) Start() {
+	s := src.s
+	s.exec(func() {
+		s.h264Users++
+		if s.h264Users == 1 {
+			s.log.Info("starting h264 encoder")
+			s.codec.StartH264(s.h264Config().Bitrate * 1000)
+		}
+	})
+}
+
+func (src h264Source) Stop() {
+	s := src.s
+	s.exec(func() {
+		s.h264Users--
+		if s.h264Users == 0 {
+			s.log.Info("stopping h264 encoder")
+			s.codec.StopH264()
+		}
+	})
+}
+
+func (src h264Source) RequestKeyFrame() {
+	s := src.s
+	s.exec(func() {
+		s.codec.RequestKeyFrame()
+	})
+}
+
+// encodeH264 encodes last decoded frame for active streams
+func (s *Server) encodeH264() {
+	rtspActive := s.rtsp.Active()
+	hlsActive := s.hls.Active()
+
+	if !rtspActive && !hlsActive {
+		return
+	}
+
+	now := time.Now()
+	pts := int64(now.Sub(s.videoEpoch)) * h264ClockRate / int64(time.Second)
+
+	au, key := s.codec.EncodeH264(pts)
+	if au == nil {
+		return
+	}
+
+	if rtspActive {
+		s.rtsp.WriteH264(au, key, pts, now)
+	}
+
+	if hlsActive {
+		var width, height int
+		if key {
+			width, height = s.codec.H264Size()
+		}
+		s.hls.WriteH264(au, key, pts, width, height)
+	}
+}
@@ -0,0 +1,64 @@
+package event
+
+import "sync"
+
+// Filter returns true for events which should be delivered to sink
+type Filter func(e Event) bool
+
+type subscriber struct {
+	sink   Sink
+	filter Filter
+}
+
+// Bus delivers published events to subscribed sinks
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string]subscriber
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[string]subscriber)}
+}
+
+// Subscribe adds sink with unique key, sink with the same key is replaced.
+// All events are delivered when filter is nil.
+func (b *Bus) Subscribe(key string, sink Sink, filter Filter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[key] = subscriber{sink: sink, filter: filter}
+}
+
+func (b *Bus) Unsubscribe(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, key)
+}
+
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, s := range b.subs {
+		if s.filter == nil || s.filter(e) {
+			s.sink.Publish(e)
+		}
+	}
+}
+
+// TypeFilter returns filter for given types, nil filter is returned for empty types
+func TypeFilter(types []Type) Filter {
+	if len(types) == 0 {
+		return nil
+	}
+
+	m := make(map[Type]bool)
+	for _, t := range types {
+		m[t] = true
+	}
+
+	return func(e Event) bool {
+		return m[e.Type]
+	}
+}
@@ -0,0 +1,85 @@
+package event
+
+import "time"
+
+type Type string
+
+const (
+	// Bell is sent when visitor rings
+	Bell Type = "bell"
+	// BellStop is sent when camera stops ringing
+	BellStop Type = "bell_stop"
+	Answer   Type = "answer"
+	Reject   Type = "reject"
+	// Suppress is sent when client silences the bell on other clients
+	Suppress Type = "suppress"
+	Door     Type = "door"
+	// Trigger is sent when output other than door is triggered
+	Trigger Type = "trigger"
+
+	CameraOnline  Type = "camera_online"
+	CameraOffline Type = "camera_offline"
+
+	// events sent by camera itself
+	Motion Type = "motion"
+	// Access is sent on keypad or rfid access
+	Access Type = "access"
+	Tamper Type = "tamper"
+	// Input is sent when camera signal input is changed
+	Input Type = "input"
+)
+
+var Types = []Type{
+	Bell, BellStop, Answer, Reject, Suppress, Door, Trigger, CameraOnline, CameraOffline,
+	Motion, Access, Tamper, Input,
+}
+
+// CameraTypes are types of unsolicited camera events
+var CameraTypes = []Type{Motion, Access, Tamper, Input}
+
+func (t Type) Valid() bool {
+	for _, v := range Types {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Addressee is a bell button of door station
+type Addressee struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Event struct {
+	Type   Type      `json:"type"`
+	Camera string    `json:"camera"`
+	Time   time.Time `json:"time"`
+	// user and address of client which caused event
+	User   string `json:"user,omitempty"`
+	Client string `json:"client,omitempty"`
+	// bell button for bell events
+	Addressee *Addressee `json:"addressee,omitempty"`
+	// triggered output for door and trigger events
+	Output string `json:"output,omitempty"`
+	// original name and parameters of camera events
+	Name   string      `json:"name,omitempty"`
+	Params interface{} `json:"params,omitempty"`
+	// jpeg taken on ring, it is stored in history only
+	Snapshot []byte `json:"-"`
+}
+
+// Sink receives events, Publish must never block
+type Sink interface {
+	Publish(e Event)
+}
+
+func New(t Type, camera string) Event {
+	return Event{
+		Type:   t,
+		Camera: camera,
+		Time:   time.Now(),
+	}
+}
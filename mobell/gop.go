@@ -0,0 +1,33 @@
+package mobell
+
+// gop is limited, cause camera may send key frames very rarely
+const maxGopSize = 16 * 1024 * 1024
+
+// gopCache keeps last key frame and all following delta frames.
+// It is used instead of frame encoding for new clients when proxy is built without codec.
+type gopCache struct {
+	frames [][]byte
+	size   int
+}
+
+func (g *gopCache) add(data []byte, key bool) {
+	if key {
+		g.reset()
+	} else if g.frames == nil {
+		// waiting for key frame
+		return
+	}
+
+	g.size += len(data)
+	if g.size > maxGopSize {
+		g.reset()
+		return
+	}
+
+	g.frames = append(g.frames, data)
+}
+
+func (g *gopCache) reset() {
+	g.frames = nil
+	g.size = 0
+}
@@ -0,0 +1,61 @@
+package h264
+
+import (
+	"bytes"
+)
+
+// nal unit types
+const (
+	NalIdr = 5
+	NalSps = 7
+	NalPps = 8
+	NalAud = 9
+)
+
+func NalType(nalu []byte) int {
+	return int(nalu[0] & 0x1f)
+}
+
+// SplitNalUnits splits annex b byte stream into nal units without start codes
+func SplitNalUnits(data []byte) [][]byte {
+	var nalus [][]byte
+
+	startCode := []byte{0, 0, 1}
+
+	i := bytes.Index(data, startCode)
+	if i < 0 {
+		return nil
+	}
+
+	data = data[i+3:]
+	for len(data) > 0 {
+		next := bytes.Index(data, startCode)
+		if next < 0 {
+			nalus = append(nalus, data)
+			break
+		}
+
+		// 4 bytes start code has extra leading zero
+		if nalu := bytes.TrimRight(data[:next], "\x00"); len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+
+		data = data[next+3:]
+	}
+
+	return nalus
+}
+
+// ParameterSets returns sps and pps from nal units
+func ParameterSets(nalus [][]byte) (sps []byte, pps []byte) {
+	for _, nalu := range nalus {
+		switch NalType(nalu) {
+		case NalSps:
+			sps = nalu
+		case NalPps:
+			pps = nalu
+		}
+	}
+
+	return sps, pps
+}
@@ -0,0 +1,114 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/history"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// parseSince accepts rfc3339 time or unix timestamp in seconds
+func parseSince(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, v)
+}
+
+// handleEvents handles /api/events?since=<time>&camera=<name>&limit=<n>
+func (p *Proxy) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleView); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := p.historyStore()
+	if h == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "bad since", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := intParam(r, "limit", 1, maxEventsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultEventsLimit
+	}
+
+	events, err := h.Events(since, r.URL.Query().Get("camera"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, events)
+}
+
+// handleEventSnapshot handles /api/events/{id}/snapshot.jpg
+func (p *Proxy) handleEventSnapshot(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleView); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := p.historyStore()
+	if h == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/events/")
+	idStr, ok := strings.CutSuffix(path, "/snapshot.jpg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "bad event id", http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.Snapshot(id)
+	if err == history.ErrNotFound {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// snapshots are never changed
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(data)
+}
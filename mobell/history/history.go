@@ -0,0 +1,275 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	bolt "go.etcd.io/bbolt"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("event not found")
+
+var (
+	eventsBucket    = []byte("events")
+	snapshotsBucket = []byte("snapshots")
+)
+
+// number of events waiting for storing, new events are dropped on overflow
+const queueSize = 64
+
+const cleanupInterval = time.Hour
+
+// Record is a stored event
+type Record struct {
+	Id uint64 `json:"id"`
+	event.Event
+	HasSnapshot bool `json:"snapshot"`
+}
+
+// Store keeps events in bolt database
+type Store struct {
+	cfg    config.History
+	db     *bolt.DB
+	events map[event.Type]bool
+	queue  chan event.Event
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	log log.Interface
+}
+
+func Open(cfg config.History) (*Store, error) {
+	var events map[event.Type]bool
+	if len(cfg.Events) > 0 {
+		events = make(map[event.Type]bool)
+		for _, t := range cfg.Events {
+			if !event.Type(t).Valid() {
+				return nil, fmt.Errorf("history: unknown event '%s'", t)
+			}
+			events[event.Type(t)] = true
+		}
+	}
+
+	// lock timeout, database may be still opened by previous store during reload
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(eventsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &Store{
+		cfg:    cfg,
+		db:     db,
+		events: events,
+		queue:  make(chan event.Event, queueSize),
+		done:   make(chan struct{}),
+		log:    log.WithField("history", cfg.Path),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// Close stores queued events and closes database
+func (s *Store) Close() {
+	close(s.done)
+	s.wg.Wait()
+
+	if err := s.db.Close(); err != nil {
+		s.log.WithError(err).Warn("error closing database")
+	}
+}
+
+// Publish queues event for storing
+func (s *Store) Publish(e event.Event) {
+	if s.events != nil && !s.events[e.Type] {
+		return
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+		s.log.WithField("event", e.Type).Warn("queue is full, dropping event")
+	}
+}
+
+func (s *Store) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	s.cleanup()
+
+	for {
+		select {
+		case <-s.done:
+			for {
+				select {
+				case e := <-s.queue:
+					s.store(e)
+				default:
+					return
+				}
+			}
+		case e := <-s.queue:
+			s.store(e)
+		case <-ticker.C:
+			s.cleanup()
+		}
+	}
+}
+
+func (s *Store) store(e event.Event) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(eventsBucket)
+
+		id, err := events.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		r := Record{Id: id, Event: e, HasSnapshot: len(e.Snapshot) > 0}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		if err := events.Put(key(id), data); err != nil {
+			return err
+		}
+
+		if r.HasSnapshot {
+			return tx.Bucket(snapshotsBucket).Put(key(id), e.Snapshot)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		s.log.WithError(err).WithField("event", e.Type).Error("error storing event")
+	}
+}
+
+// cleanup removes events older than max age
+func (s *Store) cleanup() {
+	if s.cfg.MaxAge == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-s.cfg.MaxAge)
+	removed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		c := tx.Bucket(eventsBucket).Cursor()
+
+		// ids are growing with time, so oldest events are first
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			if !r.Time.Before(deadline) {
+				break
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if err := snapshots.Delete(k); err != nil {
+				return err
+			}
+
+			removed++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		s.log.WithError(err).Error("error removing old events")
+	} else if removed > 0 {
+		s.log.WithField("count", removed).Debug("old events removed")
+	}
+}
+
+// Events returns up to limit latest events since given time in chronological order,
+// events for all cameras are returned when camera is empty
+func (s *Store) Events(since time.Time, camera string, limit int) ([]Record, error) {
+	records := make([]Record, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+
+		for k, v := c.Last(); k != nil && len(records) < limit; k, v = c.Prev() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			if r.Time.Before(since) {
+				break
+			}
+
+			if camera == "" || r.Camera == camera {
+				records = append(records, r)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	return records, nil
+}
+
+// Snapshot returns jpeg stored with event
+func (s *Store) Snapshot(id uint64) ([]byte, error) {
+	var data []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(snapshotsBucket).Get(key(id))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// value is valid during transaction only
+		data = append([]byte(nil), v...)
+
+		return nil
+	})
+
+	return data, err
+}
+
+func key(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
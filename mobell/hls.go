@@ -0,0 +1,67 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/hls"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	hlsPathPrefix    = "/live/"
+	hlsSegmentPrefix = "segment"
+	hlsSegmentSuffix = ".m4s"
+)
+
+// handleHls handles /live/index.m3u8, /live/init.mp4 and /live/segment<n>.m4s
+func (p *Proxy) handleHls(w http.ResponseWriter, r *http.Request, s *Server, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data []byte
+	var err error
+	var contentType string
+
+	switch {
+	case name == "index.m3u8":
+		if !s.client.Connected() {
+			cameraUnavailable(w)
+			return
+		}
+		data, err = s.hls.Playlist()
+		contentType = "application/vnd.apple.mpegurl"
+	case name == "init.mp4":
+		data, err = s.hls.Init()
+		contentType = "video/mp4"
+	case strings.HasPrefix(name, hlsSegmentPrefix) && strings.HasSuffix(name, hlsSegmentSuffix):
+		seq, e := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, hlsSegmentPrefix), hlsSegmentSuffix), 10, 32)
+		if e != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err = s.hls.Segment(uint32(seq))
+		contentType = "video/iso.segment"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch err {
+	case nil:
+	case hls.ErrNotReady:
+		cameraUnavailable(w)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if name == "index.m3u8" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	_, _ = w.Write(data)
+}
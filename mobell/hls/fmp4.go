@@ -0,0 +1,270 @@
+package hls
+
+import (
+	"encoding/binary"
+)
+
+// timescale of video track, pts are in rtp clock units
+const timescale = 90000
+
+// sample flags for trun box
+const (
+	sampleFlagsKey    = 0x02000000
+	sampleFlagsNonKey = 0x01010000
+)
+
+var matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+type sample struct {
+	// avcc encoded access unit
+	data     []byte
+	pts      int64
+	duration uint32
+	key      bool
+}
+
+// box is a simple iso bmff writer, box size is patched on close
+type box struct {
+	b     []byte
+	start []int
+}
+
+func (w *box) open(typ string) {
+	w.start = append(w.start, len(w.b))
+	w.u32(0)
+	w.b = append(w.b, typ...)
+}
+
+// openFull opens full box with version and flags
+func (w *box) openFull(typ string, version byte, flags uint32) {
+	w.open(typ)
+	w.u32(uint32(version)<<24 | flags)
+}
+
+func (w *box) close() {
+	start := w.start[len(w.start)-1]
+	w.start = w.start[:len(w.start)-1]
+	binary.BigEndian.PutUint32(w.b[start:], uint32(len(w.b)-start))
+}
+
+func (w *box) u8(v byte) {
+	w.b = append(w.b, v)
+}
+
+func (w *box) u16(v uint16) {
+	w.b = binary.BigEndian.AppendUint16(w.b, v)
+}
+
+func (w *box) u32(v uint32) {
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+}
+
+func (w *box) u64(v uint64) {
+	w.b = binary.BigEndian.AppendUint64(w.b, v)
+}
+
+func (w *box) zeros(n int) {
+	w.b = append(w.b, make([]byte, n)...)
+}
+
+func (w *box) bytes(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+func (w *box) matrix() {
+	for _, v := range matrix {
+		w.u32(v)
+	}
+}
+
+// initSegment returns ftyp and moov boxes for h264 track
+func initSegment(sps []byte, pps []byte, width int, height int) []byte {
+	w := &box{}
+
+	w.open("ftyp")
+	w.bytes([]byte("iso5"))
+	w.u32(512)
+	w.bytes([]byte("iso5iso6mp41"))
+	w.close()
+
+	w.open("moov")
+
+	w.openFull("mvhd", 0, 0)
+	w.u32(0) // creation time
+	w.u32(0) // modification time
+	w.u32(1000)
+	w.u32(0) // duration
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24)
+	w.u32(2) // next track id
+	w.close()
+
+	w.open("trak")
+
+	w.openFull("tkhd", 0, 3)
+	w.u32(0)
+	w.u32(0)
+	w.u32(1) // track id
+	w.u32(0)
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate group
+	w.u16(0) // volume
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(width) << 16)
+	w.u32(uint32(height) << 16)
+	w.close()
+
+	w.open("mdia")
+
+	w.openFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(timescale)
+	w.u32(0)
+	w.u16(0x55c4) // und
+	w.u16(0)
+	w.close()
+
+	w.openFull("hdlr", 0, 0)
+	w.u32(0)
+	w.bytes([]byte("vide"))
+	w.zeros(12)
+	w.bytes([]byte("VideoHandler\x00"))
+	w.close()
+
+	w.open("minf")
+
+	w.openFull("vmhd", 0, 1)
+	w.zeros(8)
+	w.close()
+
+	w.open("dinf")
+	w.openFull("dref", 0, 0)
+	w.u32(1)
+	w.openFull("url ", 0, 1)
+	w.close()
+	w.close()
+	w.close()
+
+	w.open("stbl")
+
+	w.openFull("stsd", 0, 0)
+	w.u32(1)
+	w.open("avc1")
+	w.zeros(6)
+	w.u16(1) // data reference index
+	w.zeros(16)
+	w.u16(uint16(width))
+	w.u16(uint16(height))
+	w.u32(0x00480000)
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1) // frame count
+	w.zeros(32)
+	w.u16(0x0018)
+	w.u16(0xffff)
+
+	w.open("avcC")
+	w.u8(1)
+	w.u8(sps[1])
+	w.u8(sps[2])
+	w.u8(sps[3])
+	w.u8(0xff) // 4 bytes nal unit length
+	w.u8(0xe1) // single sps
+	w.u16(uint16(len(sps)))
+	w.bytes(sps)
+	w.u8(1)
+	w.u16(uint16(len(pps)))
+	w.bytes(pps)
+	w.close()
+
+	w.close() // avc1
+	w.close() // stsd
+
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.openFull(typ, 0, 0)
+		w.u32(0)
+		w.close()
+	}
+
+	w.openFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.close()
+
+	w.close() // stbl
+	w.close() // minf
+	w.close() // mdia
+	w.close() // trak
+
+	w.open("mvex")
+	w.openFull("trex", 0, 0)
+	w.u32(1)
+	w.u32(1)
+	w.u32(0)
+	w.u32(0)
+	w.u32(0)
+	w.close()
+	w.close()
+
+	w.close() // moov
+
+	return w.b
+}
+
+// mediaSegment returns moof and mdat boxes for samples
+func mediaSegment(seq uint32, samples []*sample) []byte {
+	w := &box{}
+
+	w.open("moof")
+
+	w.openFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.close()
+
+	w.open("traf")
+
+	// default base is moof
+	w.openFull("tfhd", 0, 0x020000)
+	w.u32(1)
+	w.close()
+
+	w.openFull("tfdt", 1, 0)
+	w.u64(uint64(samples[0].pts))
+	w.close()
+
+	// data offset, sample duration, size and flags are present
+	w.openFull("trun", 0, 0x000701)
+	w.u32(uint32(len(samples)))
+	dataOffset := len(w.b)
+	w.u32(0)
+	for _, s := range samples {
+		w.u32(s.duration)
+		w.u32(uint32(len(s.data)))
+		if s.key {
+			w.u32(sampleFlagsKey)
+		} else {
+			w.u32(sampleFlagsNonKey)
+		}
+	}
+	w.close()
+
+	w.close() // traf
+	w.close() // moof
+
+	binary.BigEndian.PutUint32(w.b[dataOffset:], uint32(len(w.b)+8))
+
+	w.open("mdat")
+	for _, s := range samples {
+		w.bytes(s.data)
+	}
+	w.close()
+
+	return w.b
+}
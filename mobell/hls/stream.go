@@ -0,0 +1,325 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/h264"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotReady = errors.New("stream is not ready")
+	ErrNotFound = errors.New("segment not found")
+)
+
+// Source provides h264 frames, it is started on first request and stopped when stream is idle
+type Source interface {
+	Start()
+	Stop()
+	RequestKeyFrame()
+}
+
+type segment struct {
+	seq uint32
+	// duration in timescale units
+	duration int64
+	data     []byte
+}
+
+// Stream keeps rolling window of fmp4 segments in memory
+type Stream struct {
+	source Source
+
+	mu         sync.Mutex
+	cfg        config.HLS
+	running    bool
+	closed     bool
+	lastAccess time.Time
+	// closed when first segment is ready
+	readyCh chan struct{}
+	stopCh  chan struct{}
+
+	init     []byte
+	segments []*segment
+	seq      uint32
+	pending  []*sample
+	// key frame is requested once per segment
+	keyRequested bool
+}
+
+func NewStream(source Source) *Stream {
+	return &Stream{
+		source: source,
+		cfg:    config.Default().HLS,
+	}
+}
+
+// Configure applies new settings, they are used for next segments
+func (s *Stream) Configure(cfg config.HLS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg = cfg
+}
+
+func (s *Stream) Active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.running
+}
+
+// Close stops stream, it can't be used after closing
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.stop()
+}
+
+// touch updates last access time and starts stream if it is not running
+func (s *Stream) touch() {
+	s.mu.Lock()
+
+	s.lastAccess = time.Now()
+	start := !s.running && !s.closed
+	if start {
+		s.running = true
+		s.readyCh = make(chan struct{})
+		s.stopCh = make(chan struct{})
+		go s.watchIdle(s.stopCh)
+	}
+
+	s.mu.Unlock()
+
+	if start {
+		s.source.Start()
+	}
+}
+
+// stop drops all segments, must be called with lock
+func (s *Stream) stop() {
+	if !s.running {
+		return
+	}
+
+	s.running = false
+	close(s.stopCh)
+
+	s.init = nil
+	s.segments = nil
+	s.pending = nil
+	s.keyRequested = false
+}
+
+func (s *Stream) watchIdle(stopCh chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		idle := time.Since(s.lastAccess) > s.cfg.IdleTimeout
+		if idle {
+			s.stop()
+		}
+		s.mu.Unlock()
+
+		if idle {
+			s.source.Stop()
+			return
+		}
+	}
+}
+
+// Playlist starts stream if needed and returns media playlist when first segment is ready
+func (s *Stream) Playlist() ([]byte, error) {
+	s.touch()
+
+	s.mu.Lock()
+	readyCh := s.readyCh
+	timeout := s.cfg.SegmentDuration*2 + time.Second*5
+	s.mu.Unlock()
+
+	select {
+	case <-readyCh:
+	case <-time.After(timeout):
+		return nil, ErrNotReady
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// first request may wait for segment for a long time
+	s.lastAccess = time.Now()
+
+	if len(s.segments) == 0 {
+		return nil, ErrNotReady
+	}
+
+	target := 1
+	for _, seg := range s.segments {
+		if d := int(math.Ceil(float64(seg.duration) / timescale)); d > target {
+			target = d
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", target))
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", s.segments[0].seq))
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for _, seg := range s.segments {
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", float64(seg.duration)/timescale))
+		b.WriteString(fmt.Sprintf("segment%d.m4s\n", seg.seq))
+	}
+
+	return []byte(b.String()), nil
+}
+
+// Init returns initialization segment
+func (s *Stream) Init() ([]byte, error) {
+	s.touch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.init == nil {
+		return nil, ErrNotReady
+	}
+
+	return s.init, nil
+}
+
+func (s *Stream) Segment(seq uint32) ([]byte, error) {
+	s.touch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		if seg.seq == seq {
+			return seg.data, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// WriteH264 adds annex b access unit with pts in 90kHz units, size is required for key frames only
+func (s *Stream) WriteH264(au []byte, key bool, pts int64, width int, height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return
+	}
+
+	nalus := h264.SplitNalUnits(au)
+
+	if key {
+		s.updateInit(nalus, width, height)
+	}
+
+	// segments always start with key frame
+	if len(s.pending) == 0 && (!key || s.init == nil) {
+		return
+	}
+
+	if len(s.pending) > 0 {
+		last := s.pending[len(s.pending)-1]
+		d := pts - last.pts
+		if d <= 0 {
+			d = 1
+		}
+		last.duration = uint32(d)
+
+		target := int64(s.cfg.SegmentDuration) * timescale / int64(time.Second)
+		if pts-s.pending[0].pts >= target {
+			if key {
+				s.cut()
+			} else if !s.keyRequested {
+				s.keyRequested = true
+				s.source.RequestKeyFrame()
+			}
+		}
+	}
+
+	s.pending = append(s.pending, &sample{data: avcc(nalus), pts: pts, key: key})
+}
+
+// cut creates segment from pending samples, must be called with lock
+func (s *Stream) cut() {
+	var duration int64
+	for _, smp := range s.pending {
+		duration += int64(smp.duration)
+	}
+
+	s.segments = append(s.segments, &segment{
+		seq:      s.seq,
+		duration: duration,
+		data:     mediaSegment(s.seq, s.pending),
+	})
+	s.seq++
+
+	if n := len(s.segments) - s.cfg.Segments; n > 0 {
+		s.segments = s.segments[n:]
+	}
+
+	s.pending = nil
+	s.keyRequested = false
+
+	select {
+	case <-s.readyCh:
+	default:
+		close(s.readyCh)
+	}
+}
+
+// updateInit creates new init segment when parameter sets are changed, must be called with lock
+func (s *Stream) updateInit(nalus [][]byte, width int, height int) {
+	sps, pps := h264.ParameterSets(nalus)
+	if len(sps) < 4 || len(pps) == 0 {
+		return
+	}
+
+	init := initSegment(sps, pps, width, height)
+	if bytes.Equal(init, s.init) {
+		return
+	}
+
+	// old segments can't be played with new init segment
+	s.init = init
+	s.segments = nil
+	s.pending = nil
+}
+
+// avcc converts nal units to length prefixed format, parameter sets are stored in init segment
+func avcc(nalus [][]byte) []byte {
+	var b []byte
+	for _, nalu := range nalus {
+		switch h264.NalType(nalu) {
+		case h264.NalSps, h264.NalPps, h264.NalAud:
+			continue
+		}
+
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+		b = append(b, nalu...)
+	}
+
+	return b
+}
@@ -0,0 +1,152 @@
+package mobell
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/apex/log"
+	"mobell-proxy/mobell/auth"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpServer serves metrics and other http endpoints on separate listen address
+type httpServer struct {
+	addr  string
+	certs *certStore
+	srv   *http.Server
+}
+
+func (p *Proxy) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/api/status", p.handleStatus)
+	mux.HandleFunc("/api/clients", p.handleClients)
+	mux.HandleFunc("/api/clients/", p.handleClient)
+	mux.HandleFunc("/api/events", p.handleEvents)
+	mux.HandleFunc("/api/outputs", p.handleOutputs)
+	mux.HandleFunc("/api/outputs/", p.handleOutput)
+	mux.HandleFunc("/api/events/", p.handleEventSnapshot)
+	mux.HandleFunc("/", p.handleCamera)
+
+	return mux
+}
+
+// handleCamera handles camera endpoints, camera is selected with /door/<name> prefix like for clients
+func (p *Proxy) handleCamera(w http.ResponseWriter, r *http.Request) {
+	s, path := p.route(r.URL.Path)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch path {
+	case "/snapshot.jpg":
+		if _, ok := p.authorize(w, r, roleView); ok {
+			p.handleSnapshot(w, r, s)
+		}
+	case "/video.mjpg":
+		if _, ok := p.authorize(w, r, roleView); ok {
+			p.handleMjpeg(w, r, s)
+		}
+	default:
+		if strings.HasPrefix(path, hlsPathPrefix) {
+			if _, ok := p.authorize(w, r, roleView); ok {
+				p.handleHls(w, r, s, strings.TrimPrefix(path, hlsPathPrefix))
+			}
+			return
+		}
+
+		http.NotFound(w, r)
+	}
+}
+
+// authorize checks request credentials and user role, error response is sent on failure
+func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request, required role) (string, bool) {
+	user := ""
+
+	if r.TLS != nil {
+		user = clientCertUser(r.TLS)
+	}
+
+	if user == "" {
+		a := p.authenticator()
+		if a.Enabled() {
+			u, err := a.Check(r.Method, r.RequestURI, r.Header.Get("Authorization"))
+			if err != nil {
+				for _, h := range a.Challenge(err == auth.ErrStaleNonce) {
+					w.Header().Add("WWW-Authenticate", h)
+				}
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return "", false
+			}
+			user = u
+		}
+	}
+
+	if p.userRole(user) < required {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", false
+	}
+
+	return user, true
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("error writing json response")
+	}
+}
+
+// listenHttp (re)starts http server, must be called with proxy lock
+func (p *Proxy) listenHttp(addr string) error {
+	old := p.http
+	if old != nil && old.addr == addr {
+		if old.certs == p.certs {
+			return nil
+		}
+
+		// tls settings are changed, we need to free address before listening again
+		_ = old.srv.Close()
+		old = nil
+	}
+
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		srv := &http.Server{
+			Handler:           p.handler(),
+			ReadHeaderTimeout: time.Second * 10,
+			BaseContext: func(net.Listener) context.Context {
+				return p.runCtx
+			},
+		}
+
+		if p.certs != nil {
+			ln = tls.NewListener(ln, p.certs.config())
+		}
+
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("http server failed")
+			}
+		}()
+
+		log.WithField("addr", addr).Info("http listening")
+		p.http = &httpServer{addr: addr, certs: p.certs, srv: srv}
+	} else {
+		p.http = nil
+	}
+
+	if old != nil {
+		_ = old.srv.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package mobell
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/apex/log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// path prefix used to select camera on shared listener: /door/<name>
+const cameraPathPrefix = "/door/"
+
+type router interface {
+	// route finds server for request path and returns path without camera prefix
+	route(path string) (*Server, string)
+}
+
+type listener struct {
+	addr  string
+	ln    net.Listener
+	proxy *Proxy
+}
+
+func listen(ctx context.Context, addr string, p *Proxy, r router) (*listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{
+		addr:  addr,
+		ln:    ln,
+		proxy: p,
+	}
+
+	go l.accept(ctx, r)
+
+	return l, nil
+}
+
+func (l *listener) close() {
+	_ = l.ln.Close()
+}
+
+func (l *listener) accept(ctx context.Context, r router) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			log.WithField("addr", l.addr).Debug("finished accepting new connections")
+			break
+		}
+
+		log.Debug("connection accepted")
+
+		setKeepalive(conn)
+
+		if tlsCfg := l.proxy.tlsConfig(); tlsCfg != nil {
+			conn = tls.Server(conn, tlsCfg)
+		}
+
+		handleConnection(ctx, conn, l.proxy, r)
+	}
+}
+
+func setKeepalive(c net.Conn) {
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		log.Warn("can't enable keepalive - not a tcp connection")
+		return
+	}
+
+	if conn.SetKeepAlive(true) != nil {
+		log.Warn("can't enable keepalive")
+	}
+
+	if conn.SetKeepAlivePeriod(time.Second*120) != nil {
+		log.Warn("can't set keepalive period")
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		log.Warn("can't get raw connection")
+		return
+	}
+
+	err = rawConn.Control(func(fdPtr uintptr) {
+		fd := int(fdPtr)
+
+		if syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3) != nil {
+			log.Warn("can't set number of probes")
+		}
+
+		if syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 5) != nil {
+			log.Warn("can't set retry delay")
+		}
+	})
+
+	if err != nil {
+		log.Warn("can't set additional keepalive paramteres")
+	}
+}
+
+// splitCameraPath splits /door/<name>/rest into camera name and rest of the path
+func splitCameraPath(path string) (name string, rest string, ok bool) {
+	if !strings.HasPrefix(path, cameraPathPrefix) {
+		return "", path, false
+	}
+
+	name = path[len(cameraPathPrefix):]
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+
+	return name, rest, true
+}
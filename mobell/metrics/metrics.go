@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Type string
+
+const (
+	Counter Type = "counter"
+	Gauge   Type = "gauge"
+)
+
+// Writer writes metrics in prometheus text format.
+// All samples of one metric should be written one after another.
+type Writer struct {
+	w    *bufio.Writer
+	last string
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write writes one sample, labels are name and value pairs
+func (w *Writer) Write(name string, t Type, help string, value float64, labels ...string) {
+	if name != w.last {
+		w.last = name
+		_, _ = fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, t)
+	}
+
+	_, _ = w.w.WriteString(name)
+
+	if len(labels) > 0 {
+		_ = w.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				_ = w.w.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(w.w, "%s=\"%s\"", labels[i], escape(labels[i+1]))
+		}
+		_ = w.w.WriteByte('}')
+	}
+
+	_ = w.w.WriteByte(' ')
+	_, _ = w.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	_ = w.w.WriteByte('\n')
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,105 @@
+package mobell
+
+import (
+	"github.com/apex/log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// handleMjpeg handles /video.mjpg?width=<px>&quality=<1-100>&fps=<n>,
+// fps may only lower configured frame rate
+func (p *Proxy) handleMjpeg(w http.ResponseWriter, r *http.Request, s *Server) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	width, err := intParam(r, "width", 1, maxSnapshotWidth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	quality, err := intParam(r, "quality", 1, 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxFps := p.httpConfig().MjpegFps
+	fps, err := intParam(r, "fps", 1, maxFps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fps == 0 {
+		fps = maxFps
+	}
+
+	sn, err := s.snapshot(width, quality, 0)
+	if err != nil {
+		cameraUnavailable(w)
+		return
+	}
+
+	l := s.log.WithFields(log.Fields{"addr": r.RemoteAddr, "fps": fps})
+	l.Info("mjpeg stream started")
+	defer l.Info("mjpeg stream finished")
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+
+	flusher, _ := w.(http.Flusher)
+
+	interval := time.Second / time.Duration(fps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last *snapshot
+
+	for {
+		// same snapshot is returned when there are no new frames, camera may be down as well
+		if sn != nil && sn != last {
+			if err := writeJpegPart(mw, sn.data); err != nil {
+				l.WithError(err).Debug("error writing frame")
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			last = sn
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// shared between viewers with the same parameters
+		sn, _ = s.snapshot(width, quality, interval/2)
+	}
+}
+
+func writeJpegPart(mw *multipart.Writer, data []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "image/jpeg")
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = pw.Write(data)
+
+	return err
+}
@@ -0,0 +1,52 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/mqtt"
+	"mobell-proxy/mobell/protocol"
+)
+
+// mqttBackend connects mqtt bridge with proxy
+type mqttBackend struct {
+	p *Proxy
+}
+
+func (b mqttBackend) Cameras() []string {
+	var cameras []string
+	for _, s := range b.p.serverList() {
+		cameras = append(cameras, s.name)
+	}
+
+	return cameras
+}
+
+func (b mqttBackend) State(camera string) (bool, bool) {
+	s := b.p.server(camera)
+	if s == nil {
+		return false, false
+	}
+
+	st := s.status()
+
+	return st.Connected, st.Ringing
+}
+
+func (b mqttBackend) Command(camera string, cmd string) error {
+	s := b.p.server(camera)
+	if s == nil {
+		return errUnknownCamera
+	}
+
+	switch cmd {
+	case mqtt.CmdOpenDoor:
+		return s.trigger(nil, config.DoorOutput, s.logCmdError(protocol.MethodTrigger))
+	case mqtt.CmdRing:
+		s.sendBell(true)
+	case mqtt.CmdStopRing:
+		s.sendBell(false)
+	default:
+		return mqtt.ErrUnknownCommand
+	}
+
+	return nil
+}
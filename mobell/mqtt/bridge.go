@@ -0,0 +1,272 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commands accepted on <prefix>/<camera>/command topic
+const (
+	CmdOpenDoor = "open_door"
+	CmdRing     = "ring"
+	CmdStopRing = "stop_ring"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+// number of events waiting for publishing, new events are dropped on overflow
+const queueSize = 64
+
+const (
+	on  = "ON"
+	off = "OFF"
+)
+
+// Backend provides cameras state and executes commands
+type Backend interface {
+	Cameras() []string
+	State(camera string) (connected bool, ringing bool)
+	Command(camera string, cmd string) error
+}
+
+// Bridge publishes events and camera state to mqtt broker and receives commands
+type Bridge struct {
+	cfg     config.MQTT
+	backend Backend
+	client  paho.Client
+	queue   chan event.Event
+
+	// retained state is published on every connect
+	mu      sync.Mutex
+	ringing map[string]bool
+	online  map[string]bool
+
+	done chan struct{}
+
+	log log.Interface
+}
+
+func New(cfg config.MQTT, backend Backend) *Bridge {
+	b := &Bridge{
+		cfg:     cfg,
+		backend: backend,
+		queue:   make(chan event.Event, queueSize),
+		ringing: make(map[string]bool),
+		online:  make(map[string]bool),
+		done:    make(chan struct{}),
+		log:     log.WithField("mqtt", cfg.Broker),
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientId).
+		SetUsername(cfg.User).
+		SetPassword(cfg.Pass).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second*5).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(b.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			b.log.WithError(err).Warn("connection lost")
+		})
+
+	b.client = paho.NewClient(opts)
+
+	return b
+}
+
+func (b *Bridge) Start() {
+	// connect is retried in background
+	b.client.Connect()
+	go b.run()
+}
+
+func (b *Bridge) Stop() {
+	close(b.done)
+
+	if b.client.IsConnectionOpen() {
+		b.client.Publish(b.statusTopic(), 1, true, "offline").WaitTimeout(time.Second)
+	}
+	b.client.Disconnect(250)
+}
+
+// Publish queues event for publishing
+func (b *Bridge) Publish(e event.Event) {
+	select {
+	case b.queue <- e:
+	default:
+		b.log.WithField("event", e.Type).Warn("queue is full, dropping event")
+	}
+}
+
+func (b *Bridge) run() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case e := <-b.queue:
+			b.handleEvent(e)
+		}
+	}
+}
+
+func (b *Bridge) handleEvent(e event.Event) {
+	b.mu.Lock()
+	switch e.Type {
+	case event.Bell:
+		b.ringing[e.Camera] = true
+	case event.BellStop, event.Answer, event.Reject, event.Door:
+		b.ringing[e.Camera] = false
+	case event.CameraOnline:
+		b.online[e.Camera] = true
+	case event.CameraOffline:
+		b.online[e.Camera] = false
+	}
+	ringing := b.ringing[e.Camera]
+	online := b.online[e.Camera]
+	b.mu.Unlock()
+
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+
+	b.publishState(e.Camera, online, ringing)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		b.log.WithError(err).Error("error marshalling event")
+		return
+	}
+
+	b.client.Publish(b.topic(e.Camera, "event"), 1, false, data)
+}
+
+func (b *Bridge) publishState(camera string, online bool, ringing bool) {
+	b.client.Publish(b.topic(camera, "connected"), 1, true, onOff(online))
+	b.client.Publish(b.topic(camera, "ringing"), 1, true, onOff(ringing))
+}
+
+func (b *Bridge) onConnect(c paho.Client) {
+	b.log.Info("connected")
+
+	c.Publish(b.statusTopic(), 1, true, "online")
+
+	for _, camera := range b.backend.Cameras() {
+		online, ringing := b.backend.State(camera)
+
+		b.mu.Lock()
+		b.online[camera] = online
+		b.ringing[camera] = ringing
+		b.mu.Unlock()
+
+		if b.cfg.Discovery {
+			b.publishDiscovery(camera)
+		}
+
+		b.publishState(camera, online, ringing)
+	}
+
+	c.Subscribe(b.cfg.Prefix+"/+/command", 1, b.onCommand)
+}
+
+func (b *Bridge) onCommand(_ paho.Client, msg paho.Message) {
+	// <prefix>/<camera>/command
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), b.cfg.Prefix+"/"), "/")
+	if len(parts) != 2 {
+		return
+	}
+
+	camera := parts[0]
+	cmd := strings.TrimSpace(string(msg.Payload()))
+
+	l := b.log.WithField("camera", camera).WithField("cmd", cmd)
+	l.Info("received command")
+
+	if err := b.backend.Command(camera, cmd); err != nil {
+		l.WithError(err).Warn("error executing command")
+	}
+}
+
+func (b *Bridge) topic(camera string, name string) string {
+	return b.cfg.Prefix + "/" + camera + "/" + name
+}
+
+func (b *Bridge) statusTopic() string {
+	return b.cfg.Prefix + "/status"
+}
+
+// publishDiscovery publishes home assistant mqtt discovery configs
+func (b *Bridge) publishDiscovery(camera string) {
+	id := "mobell_" + camera
+	device := map[string]interface{}{
+		"identifiers":  []string{id},
+		"name":         "Mobell " + camera,
+		"manufacturer": "Mobotix",
+	}
+
+	entities := []struct {
+		component string
+		name      string
+		cfg       map[string]interface{}
+	}{
+		{"binary_sensor", "ringing", map[string]interface{}{
+			"state_topic": b.topic(camera, "ringing"),
+			"icon":        "mdi:doorbell",
+		}},
+		{"binary_sensor", "connected", map[string]interface{}{
+			"state_topic":  b.topic(camera, "connected"),
+			"device_class": "connectivity",
+		}},
+		{"button", CmdOpenDoor, map[string]interface{}{
+			"command_topic": b.topic(camera, "command"),
+			"payload_press": CmdOpenDoor,
+			"icon":          "mdi:door-open",
+		}},
+		{"button", CmdRing, map[string]interface{}{
+			"command_topic": b.topic(camera, "command"),
+			"payload_press": CmdRing,
+			"icon":          "mdi:bell-ring",
+		}},
+		{"button", CmdStopRing, map[string]interface{}{
+			"command_topic": b.topic(camera, "command"),
+			"payload_press": CmdStopRing,
+			"icon":          "mdi:bell-off",
+		}},
+	}
+
+	for _, e := range entities {
+		cfg := e.cfg
+		cfg["name"] = strings.ReplaceAll(e.name, "_", " ")
+		cfg["unique_id"] = id + "_" + e.name
+		cfg["object_id"] = id + "_" + e.name
+		cfg["availability_topic"] = b.statusTopic()
+		cfg["device"] = device
+
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			b.log.WithError(err).Error("error marshalling discovery config")
+			continue
+		}
+
+		topic := fmt.Sprintf("%s/%s/%s_%s/config", b.cfg.DiscoveryPrefix, e.component, id, e.name)
+		b.client.Publish(topic, 1, true, data)
+	}
+}
+
+func onOff(v bool) string {
+	if v {
+		return on
+	}
+
+	return off
+}
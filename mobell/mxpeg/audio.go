@@ -0,0 +1,16 @@
+package mxpeg
+
+// AudioSampleRate is a sample rate of pcm16 audio requested with audiooutput command
+const AudioSampleRate = 16000
+
+// pcm audio packet header: marker, length, "MXA\0", duration and timestamp
+const audioHeaderLen = 2 + 2 + 4 + 4 + 8
+
+// AudioSamples returns little endian pcm16 samples of audio packet
+func AudioSamples(packet []byte) []byte {
+	if len(packet) < audioHeaderLen {
+		return nil
+	}
+
+	return packet[audioHeaderLen:]
+}
@@ -0,0 +1,176 @@
+package mxpeg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mobell-proxy/mobell/protocol"
+	"sync/atomic"
+	"time"
+)
+
+// used for calls without deadline, so callbacks are never kept forever
+const defaultCallTimeout = time.Second * 30
+
+var ErrNotConnected = errors.New("camera is not connected")
+var ErrStreamClosed = errors.New("camera stream closed")
+
+// CmdError is an error response from camera
+type CmdError struct {
+	Method string
+	Err    json.RawMessage
+}
+
+func (e *CmdError) Error() string {
+	return fmt.Sprintf("camera error on %s: %s", e.Method, string(e.Err))
+}
+
+// pendingCall waits for camera response, subscriptions also receive continuation responses
+type pendingCall struct {
+	method string
+	resp   chan *protocol.Message
+	cont   func(*protocol.Message)
+	// closed when stream is dropped
+	closed chan struct{}
+}
+
+// Call sends request and waits for camera response. Call is cancelled with ErrStreamClosed when stream drops,
+// default timeout is used when ctx has no deadline.
+func (c *Client) Call(ctx context.Context, method string, params interface{}) (*protocol.Message, error) {
+	id, p, err := c.send(method, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.removeCall(id)
+
+	return c.wait(ctx, p)
+}
+
+// Subscribe sends request and waits for camera response, continuation responses are passed to fn
+// until ctx is done or stream drops. fn is called from stream reader goroutine.
+func (c *Client) Subscribe(ctx context.Context, method string, params interface{}, fn func(*protocol.Message)) error {
+	id, p, err := c.send(method, params, fn)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.wait(ctx, p); err != nil {
+		c.removeCall(id)
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+		}
+		c.removeCall(id)
+	}()
+
+	return nil
+}
+
+func (c *Client) send(method string, params interface{}, cont func(*protocol.Message)) (uint32, *pendingCall, error) {
+	p := &pendingCall{
+		method: method,
+		resp:   make(chan *protocol.Message, 1),
+		cont:   cont,
+	}
+
+	c.callsMu.Lock()
+	if c.streamClosed == nil {
+		c.callsMu.Unlock()
+		return 0, nil, ErrNotConnected
+	}
+	id := atomic.AddUint32(&c.packetId, 1)
+	p.closed = c.streamClosed
+	c.calls[id] = p
+	c.callsMu.Unlock()
+
+	if err := c.sendCmd(id, method, params); err != nil {
+		c.removeCall(id)
+		return 0, nil, err
+	}
+
+	return id, p, nil
+}
+
+func (c *Client) wait(ctx context.Context, p *pendingCall) (*protocol.Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCallTimeout)
+		defer cancel()
+	}
+
+	select {
+	case m := <-p.resp:
+		if m.Failed() {
+			return nil, &CmdError{Method: p.method, Err: m.Error}
+		}
+		return m, nil
+	case <-p.closed:
+		return nil, ErrStreamClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeCall(id uint32) {
+	c.callsMu.Lock()
+	defer c.callsMu.Unlock()
+
+	delete(c.calls, id)
+}
+
+// dispatch passes response to pending call, returns false if there is no such call
+func (c *Client) dispatch(m *protocol.Message) bool {
+	if m.Id <= 0 {
+		return false
+	}
+
+	c.callsMu.Lock()
+	p := c.calls[uint32(m.Id)]
+	c.callsMu.Unlock()
+
+	if p == nil {
+		return false
+	}
+
+	if m.Type == protocol.TypeCont && p.cont != nil {
+		p.cont(m)
+		return true
+	}
+
+	select {
+	case p.resp <- m:
+	default:
+		c.log.WithField("method", p.method).Debug("duplicate response dropped")
+	}
+
+	return true
+}
+
+// openCalls allows calls on new stream
+func (c *Client) openCalls() {
+	c.callsMu.Lock()
+	defer c.callsMu.Unlock()
+
+	// reset packet id
+	atomic.StoreUint32(&c.packetId, 10)
+	c.streamClosed = make(chan struct{})
+}
+
+// closeCalls cancels pending calls and subscriptions when stream drops
+func (c *Client) closeCalls() {
+	c.callsMu.Lock()
+	defer c.callsMu.Unlock()
+
+	if c.streamClosed != nil {
+		close(c.streamClosed)
+		c.streamClosed = nil
+	}
+
+	c.calls = make(map[uint32]*pendingCall)
+}
@@ -2,10 +2,9 @@ package mxpeg
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"github.com/apex/log"
+	"mobell-proxy/mobell/protocol"
 	"mobell-proxy/mobell/stream"
 	"net/http"
 	"strconv"
@@ -19,7 +18,10 @@ import (
 // 4 mb should be enough for any frame
 const ringBufferSize = 4 * 1024 * 1024
 
-type StreamStartFunc func()
+const eventStreamPath = "/control/eventstream.jpg"
+
+// StreamStartFunc is called when stream is established, ctx is cancelled when stream drops
+type StreamStartFunc func(ctx context.Context)
 type StreamStopFunc func()
 
 type Listener struct {
@@ -31,9 +33,15 @@ type Listener struct {
 }
 
 type Client struct {
+	cfgMu       sync.Mutex
 	mobotixAddr string
 	mobotixUser string
 	mobotixPass string
+	mobotixAuth string
+
+	// authentication state, it is used from run goroutine only
+	digest *digestChallenge
+	basic  bool
 
 	runCtx      context.Context
 	runCancel   context.CancelFunc
@@ -43,27 +51,60 @@ type Client struct {
 	stream   unsafe.Pointer
 
 	packetId uint32
-	events   sync.Map
+	callsMu  sync.Mutex
+	calls    map[uint32]*pendingCall
+	// closed when stream drops, nil when there is no stream
+	streamClosed chan struct{}
+
+	reconnects uint64
 
 	log log.Interface
 }
 
-func NewClient(mobotixAddr string, mobotixUser string, mobotixPass string, listener *Listener) *Client {
+func NewClient(mobotixAddr string, mobotixUser string, mobotixPass string, mobotixAuth string, listener *Listener) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
 		mobotixAddr: mobotixAddr,
 		mobotixUser: mobotixUser,
 		mobotixPass: mobotixPass,
+		mobotixAuth: mobotixAuth,
 		runCtx:      ctx,
 		runCancel:   cancel,
 		runFinished: make(chan struct{}),
 		listener:    listener,
+		calls:       make(map[uint32]*pendingCall),
 
 		log: log.WithField("ctx", mobotixAddr),
 	}
 }
 
+// Configure updates camera address, credentials and authentication mode, returns true if anything was changed.
+// New settings are used on next connect, so Reconnect should be called to apply them immediately.
+func (c *Client) Configure(mobotixAddr string, mobotixUser string, mobotixPass string, mobotixAuth string) bool {
+	c.cfgMu.Lock()
+	defer c.cfgMu.Unlock()
+
+	if c.mobotixAddr == mobotixAddr && c.mobotixUser == mobotixUser && c.mobotixPass == mobotixPass &&
+		c.mobotixAuth == mobotixAuth {
+		return false
+	}
+
+	c.mobotixAddr = mobotixAddr
+	c.mobotixUser = mobotixUser
+	c.mobotixPass = mobotixPass
+	c.mobotixAuth = mobotixAuth
+
+	return true
+}
+
+func (c *Client) settings() (addr string, user string, pass string, mode string) {
+	c.cfgMu.Lock()
+	defer c.cfgMu.Unlock()
+
+	return c.mobotixAddr, c.mobotixUser, c.mobotixPass, c.mobotixAuth
+}
+
 func (c *Client) Start() {
 	c.log.Debug("starting")
 	go c.run()
@@ -87,6 +128,16 @@ func (c *Client) Reconnect() {
 	}
 }
 
+// Connected returns true when event stream is established
+func (c *Client) Connected() bool {
+	return atomic.LoadPointer(&c.stream) != nil
+}
+
+// Reconnects returns number of reconnects since start
+func (c *Client) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
+}
+
 func (c *Client) run() {
 	for {
 		select {
@@ -104,51 +155,27 @@ func (c *Client) run() {
 		waitCtx, waitCancel := context.WithTimeout(c.runCtx, time.Second*5)
 		_ = <-waitCtx.Done()
 		waitCancel()
+
+		if c.runCtx.Err() == nil {
+			atomic.AddUint64(&c.reconnects, 1)
+		}
 	}
 }
 
 func (c *Client) runOnce() {
-	s, err := stream.Connect(c.runCtx, c.mobotixAddr, time.Second*5, c.log)
-	if err != nil {
+	s, rb := c.connect()
+	if s == nil {
 		return
 	}
 
 	defer s.Close()
 
-	rb := NewRingBuffer(ringBufferSize, s, c.log)
-
-	host := strings.FieldsFunc(c.mobotixAddr, func(r rune) bool { return r == ':' })[0]
-	auth := base64.StdEncoding.EncodeToString([]byte(c.mobotixUser + ":" + c.mobotixPass))
-
-	msg := fmt.Sprintf(
-		"POST /control/eventstream.jpg HTTP/1.1\r\nHost: %s\r\nAuthorization: Basic %s\r\n\r\n",
-		host,
-		auth,
-	)
-
-	_, _ = s.Write([]byte(msg))
-
-	status, err := handleHttp(rb)
-	if err != nil {
-		c.log.WithError(err).Warn("error connecting")
-		return
-	}
-	if status != http.StatusOK {
-		c.log.WithField("status", status).Warn("error connecting")
-		return
-	}
-
-	// reset packet id
-	atomic.StoreUint32(&c.packetId, 10)
-	// clear old packets
-	c.events.Range(func(key, _ interface{}) bool {
-		c.events.Delete(key)
-		return true
-	})
-
+	c.openCalls()
 	atomic.StorePointer(&c.stream, unsafe.Pointer(s))
+
+	streamCtx, streamCancel := context.WithCancel(c.runCtx)
 	if c.listener.OnStreamStart != nil {
-		c.listener.OnStreamStart()
+		c.listener.OnStreamStart(streamCtx)
 	}
 
 	pr := NewReader(c.OnEvent, c.OnVideo, c.OnAudio, rb, c.log)
@@ -161,32 +188,121 @@ func (c *Client) runOnce() {
 		}
 	}
 
+	streamCancel()
+	c.closeCalls()
+
 	c.listener.OnStreamStop()
 	atomic.StorePointer(&c.stream, nil)
 }
 
-func handleHttp(rb *RingBuffer) (status int, err error) {
+// connect opens event stream, request is repeated once with new credentials when camera sends authentication challenge
+func (c *Client) connect() (*stream.Stream, *RingBuffer) {
+	addr, user, pass, mode := c.settings()
+
+	for retry := false; ; retry = true {
+		s, err := stream.Connect(c.runCtx, addr, time.Second*5, c.log)
+		if err != nil {
+			return nil, nil
+		}
+
+		rb := NewRingBuffer(ringBufferSize, s, c.log)
+
+		host := strings.FieldsFunc(addr, func(r rune) bool { return r == ':' })[0]
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "POST %s HTTP/1.1\r\nHost: %s\r\n", eventStreamPath, host)
+		if a := c.authorization(user, pass, mode); a != "" {
+			b.WriteString("Authorization: " + a + "\r\n")
+		}
+		b.WriteString("\r\n")
+
+		_, _ = s.Write([]byte(b.String()))
+
+		status, header, err := handleHttp(rb)
+		if err != nil {
+			c.log.WithError(err).Warn("error connecting")
+			s.Close()
+			return nil, nil
+		}
+
+		if status == http.StatusOK {
+			return s, rb
+		}
+
+		s.Close()
+
+		if status == http.StatusUnauthorized && !retry && c.challenge(header.Values("WWW-Authenticate"), mode) {
+			c.log.Debug("authentication requested, retrying")
+			continue
+		}
+
+		c.log.WithField("status", status).Warn("error connecting")
+		return nil, nil
+	}
+}
+
+// authorization returns Authorization header value, it is empty when camera didn't ask for credentials yet
+func (c *Client) authorization(user string, pass string, mode string) string {
+	switch {
+	case mode == AuthBasic:
+		return basicAuthorization(user, pass)
+	case c.digest != nil:
+		return c.digest.authorization(user, pass, http.MethodPost, eventStreamPath)
+	case c.basic && mode == AuthAuto:
+		return basicAuthorization(user, pass)
+	default:
+		return ""
+	}
+}
+
+// challenge applies camera authentication challenge, returns false when it's not supported in given mode
+func (c *Client) challenge(values []string, mode string) bool {
+	digest, basic := parseChallenges(values)
+
+	if digest != nil && mode != AuthBasic {
+		c.digest = digest
+		c.basic = false
+		return true
+	}
+
+	if basic && mode == AuthAuto {
+		c.digest = nil
+		c.basic = true
+		return true
+	}
+
+	c.log.WithField("challenge", values).WithField("auth", mode).Warn("camera authentication is not supported")
+
+	return false
+}
+
+func handleHttp(rb *RingBuffer) (status int, header http.Header, err error) {
 	defer rb.Recover(&err)
 
 	// get/post request
 	f := strings.Fields(ReadLine(rb))
 	if len(f) < 2 {
-		return 0, ErrReadError
+		return 0, nil, ErrReadError
 	}
 
 	s, err := strconv.Atoi(f[1])
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
+	header = make(http.Header)
 	for {
 		line := ReadLine(rb)
 		if len(line) == 0 {
 			break
 		}
+
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+		}
 	}
 
-	return s, nil
+	return s, header, nil
 }
 
 func ReadLine(rb *RingBuffer) string {
@@ -218,60 +334,32 @@ func (c *Client) Write(data []byte) {
 	}
 }
 
-func (c *Client) writeCmd(cmd []byte) {
-	l := len(cmd)
-	b := make([]byte, l+2)
-	copy(b, cmd)
-	b[l] = 0x0a
-	b[l+1] = 0
-	c.Write(b)
-}
-
+// SendCmdSilent sends request without waiting for response
 func (c *Client) SendCmdSilent(method string, params interface{}) {
-	c.SendCmd(method, params, nil)
+	_ = c.sendCmd(atomic.AddUint32(&c.packetId, 1), method, params)
 }
 
-func (c *Client) SendCmd(method string, params interface{}, listener EventFunc) {
-	id := atomic.AddUint32(&c.packetId, 1)
-
-	if listener != nil {
-		c.events.Store(id, listener)
-	}
-
-	evt := map[string]interface{}{
-		"id":     id,
-		"method": method,
+func (c *Client) sendCmd(id uint32, method string, params interface{}) error {
+	cmd, err := protocol.EncodeLine(protocol.Request{Id: int(id), Method: method, Params: params})
+	if err != nil {
+		c.log.WithError(err).WithField("method", method).Error("error encoding command")
+		return err
 	}
 
-	if params != nil {
-		evt["params"] = params
-	}
+	c.log.WithField("cmd", string(cmd[:len(cmd)-2])).Debug("sending")
+	c.Write(cmd)
 
-	cmd, err := json.Marshal(evt)
+	return nil
+}
 
-	if err == nil {
-		log.WithField("cmd", string(cmd)).Debug("sending")
-		c.writeCmd(cmd)
-	} else {
-		log.Error("fatal error on marshalling event")
+func (c *Client) OnEvent(m *protocol.Message) bool {
+	if c.dispatch(m) {
+		return true
 	}
-}
 
-func (c *Client) OnEvent(evt map[string]interface{}) bool {
-	idi, ok := evt["id"]
-	if ok {
-		idf, ok := idi.(float64)
-		if ok {
-			id := uint32(idf)
-			l, ok := c.events.Load(id)
-			if ok && l != nil {
-				r := l.(EventFunc)(evt)
-				if r {
-					c.events.Delete(id)
-				}
-				return r
-			}
-		}
+	// unsolicited event
+	if c.listener.OnEvent != nil {
+		return c.listener.OnEvent(m)
 	}
 
 	return true
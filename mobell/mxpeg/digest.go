@@ -0,0 +1,137 @@
+package mxpeg
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"mobell-proxy/mobell/auth"
+	"strings"
+)
+
+// camera authentication modes
+const (
+	// digest is used when camera asks for it, basic is used only when camera doesn't support digest
+	AuthAuto = "auto"
+	// password is never sent in plaintext
+	AuthDigest = "digest"
+	// basic credentials are sent with first request
+	AuthBasic = "basic"
+)
+
+// digestChallenge is a digest challenge from camera, it is reused for reconnects until camera rejects it
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	hash      func() hash.Hash
+	// nonce count
+	nc uint32
+}
+
+// parseChallenges parses WWW-Authenticate header values, digest is nil when there is no supported digest challenge
+func parseChallenges(values []string) (digest *digestChallenge, basic bool) {
+	for _, v := range values {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+
+		switch strings.ToLower(scheme) {
+		case "basic":
+			basic = true
+		case "digest":
+			if d := parseDigest(auth.ParseParams(params)); d != nil && digest == nil {
+				digest = d
+			}
+		}
+	}
+
+	return digest, basic
+}
+
+func parseDigest(p map[string]string) *digestChallenge {
+	d := &digestChallenge{
+		realm:     p["realm"],
+		nonce:     p["nonce"],
+		opaque:    p["opaque"],
+		algorithm: p["algorithm"],
+	}
+
+	switch strings.ToUpper(d.algorithm) {
+	case "", "MD5":
+		d.hash = md5.New
+	case "SHA-256":
+		d.hash = sha256.New
+	default:
+		return nil
+	}
+
+	if d.nonce == "" {
+		return nil
+	}
+
+	// qop is a list of supported values, only auth is supported by client
+	if qop, ok := p["qop"]; ok {
+		for _, q := range strings.Split(qop, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				d.qop = "auth"
+			}
+		}
+		if d.qop == "" {
+			return nil
+		}
+	}
+
+	return d
+}
+
+// authorization returns Authorization header value for request
+func (d *digestChallenge) authorization(user string, pass string, method string, uri string) string {
+	ha1 := d.hex(user + ":" + d.realm + ":" + pass)
+	ha2 := d.hex(method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, quote(user), quote(d.realm), quote(d.nonce), quote(uri))
+
+	if d.qop == "" {
+		fmt.Fprintf(&b, `, response="%s"`, d.hex(ha1+":"+d.nonce+":"+ha2))
+	} else {
+		d.nc++
+		nc := fmt.Sprintf("%08x", d.nc)
+		cnonce := cnonce()
+		response := d.hex(ha1 + ":" + d.nonce + ":" + nc + ":" + cnonce + ":" + d.qop + ":" + ha2)
+		fmt.Fprintf(&b, `, response="%s", qop=%s, nc=%s, cnonce="%s"`, response, d.qop, nc, cnonce)
+	}
+
+	if d.algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", d.algorithm)
+	}
+	if d.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, quote(d.opaque))
+	}
+
+	return b.String()
+}
+
+func (d *digestChallenge) hex(s string) string {
+	h := d.hash()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func basicAuthorization(user string, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func cnonce() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func quote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
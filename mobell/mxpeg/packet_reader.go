@@ -1,9 +1,9 @@
 package mxpeg
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/apex/log"
+	"mobell-proxy/mobell/protocol"
 )
 
 var ErrParseError = errors.New("parse error")
@@ -23,7 +23,7 @@ const APP11 = 0xEB
 const APP12 = 0xEC
 const APP13 = 0xED
 
-type EventFunc func(map[string]interface{}) bool
+type EventFunc func(*protocol.Message) bool
 type VideoFunc func([]byte, bool)
 type AudioFunc func([]byte)
 
@@ -176,8 +176,6 @@ func (p *PacketReader) readEvents() error {
 	r.Cut()
 	r.Move(l - 2)
 
-	var evt map[string]interface{}
-
 	v := r.GetAndCut()
 	if v[len(v)-1] == 0 {
 		v = v[:len(v)-1]
@@ -185,13 +183,13 @@ func (p *PacketReader) readEvents() error {
 
 	p.log.WithField("event", string(v)).Debug("received event")
 
-	err := json.Unmarshal(v, &evt)
+	m, err := protocol.Decode(v)
 	if err != nil {
-		p.log.Warn("error unmarshal event")
+		p.log.WithError(err).Warn("error decoding event")
 		return err
 	}
 
-	p.onEvent(evt)
+	p.onEvent(m)
 
 	return nil
 }
@@ -0,0 +1,126 @@
+package mobell
+
+import (
+	"errors"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"mobell-proxy/mobell/protocol"
+	"net/http"
+	"strings"
+)
+
+var errOutputNotAllowed = errors.New("output is not allowed")
+
+type outputInfo struct {
+	Name string `json:"name"`
+	// role required for triggering
+	Role string `json:"role"`
+}
+
+type cameraOutputs struct {
+	Camera  string       `json:"camera"`
+	Outputs []outputInfo `json:"outputs"`
+}
+
+func (s *Server) getOutputs() []config.Output {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	return s.outputs
+}
+
+// output returns allowed output by name
+func (s *Server) output(name string) (config.Output, bool) {
+	for _, o := range s.getOutputs() {
+		if o.Name == name {
+			return o, true
+		}
+	}
+
+	return config.Output{}, false
+}
+
+// trigger triggers allowed output, conn is a client which triggered output and may be nil.
+// done receives camera response when output is allowed.
+func (s *Server) trigger(conn *connection, name string, done cmdDone) error {
+	if _, ok := s.output(name); !ok {
+		return errOutputNotAllowed
+	}
+
+	if name == config.DoorOutput {
+		s.openDoor(conn, done)
+		return nil
+	}
+
+	e := s.event(event.Trigger, conn)
+	e.Output = name
+	s.proxy.publish(e)
+
+	s.cameraCmd(protocol.MethodTrigger, protocol.TriggerParams{Output: name}, done)
+
+	return nil
+}
+
+// handleOutputs handles /api/outputs
+func (p *Proxy) handleOutputs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleAdmin); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	outputs := make([]cameraOutputs, 0)
+	for _, s := range p.serverList() {
+		co := cameraOutputs{Camera: s.name, Outputs: make([]outputInfo, 0)}
+		for _, o := range s.getOutputs() {
+			co.Outputs = append(co.Outputs, outputInfo{Name: o.Name, Role: o.Role})
+		}
+		outputs = append(outputs, co)
+	}
+
+	writeJson(w, outputs)
+}
+
+// handleOutput handles POST /api/outputs/{camera}/{output}
+func (p *Proxy) handleOutput(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.authorize(w, r, roleAdmin); !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/outputs/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	s := p.server(parts[0])
+	if s == nil {
+		http.Error(w, errUnknownCamera.Error(), http.StatusNotFound)
+		return
+	}
+
+	res := make(chan interface{}, 1)
+	err := s.trigger(nil, parts[1], func(_ interface{}, err interface{}) {
+		res <- err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := <-res; err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		writeJson(w, map[string]interface{}{"error": err})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/protocol"
+)
+
+// methods used by proxy itself to set up camera stream, they are never forwarded
+var reservedMethods = map[string]bool{
+	protocol.MethodMode:        true,
+	protocol.MethodAudioOutput: true,
+}
+
+var errMethodNotAllowed = &rpcError{Code: -32601, Message: "method not allowed"}
+
+func (p *Proxy) passthroughConfig() config.Passthrough {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.passCfg
+}
+
+// passthroughAllowed checks if method may be forwarded to camera by user with given role
+func (p *Proxy) passthroughAllowed(method string, r role) *rpcError {
+	if method == "" || reservedMethods[method] {
+		return errMethodNotAllowed
+	}
+
+	cfg := p.passthroughConfig()
+
+	if len(cfg.Allow) > 0 && !contains(cfg.Allow, method) {
+		return errMethodNotAllowed
+	}
+
+	if contains(cfg.Deny, method) {
+		return errMethodNotAllowed
+	}
+
+	if r < roleNames[cfg.Role] {
+		return errForbidden
+	}
+
+	return nil
+}
+
+// passthrough forwards unknown method to camera, camera response is sent with original request id.
+// Camera commands have own ids, so requests from different clients never clash.
+func (c *connection) passthrough(m *protocol.Message) {
+	if rpcErr := c.proxy.passthroughAllowed(m.Method, c.role()); rpcErr != nil {
+		c.log.WithField("method", m.Method).Warn("method is not forwarded to camera")
+		c.sendEvent(protocol.Fail(m.Id, rpcErr))
+		return
+	}
+
+	// params are forwarded as is
+	var params interface{}
+	if len(m.Params) > 0 {
+		params = m.Params
+	}
+
+	c.log.WithField("method", m.Method).Debug("forwarding method to camera")
+	c.server.cameraCmd(m.Method, params, c.respond(m.Id))
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
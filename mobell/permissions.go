@@ -0,0 +1,73 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/protocol"
+)
+
+type role int
+
+const (
+	roleView role = iota
+	roleTalk
+	roleFull
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"view":  roleView,
+	"talk":  roleTalk,
+	"full":  roleFull,
+	"admin": roleAdmin,
+}
+
+// required roles for client methods, methods not listed here are allowed for everybody,
+// trigger roles are configured per output
+var methodRoles = map[string]role{
+	protocol.MethodBellAck:  roleTalk,
+	protocol.MethodSuppress: roleTalk,
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	errForbidden     = &rpcError{Code: -32001, Message: "forbidden"}
+	errInvalidParams = &rpcError{Code: -32602, Message: "invalid params"}
+	errUnknownOutput = &rpcError{Code: -32602, Message: "unknown output"}
+)
+
+// invalidParams returns invalid params error with decode error details
+func invalidParams(err error) *rpcError {
+	return &rpcError{Code: errInvalidParams.Code, Message: err.Error()}
+}
+
+func (r role) canTalk() bool {
+	return r >= roleTalk
+}
+
+func (r role) allowed(method string) bool {
+	required, ok := methodRoles[method]
+	return !ok || r >= required
+}
+
+type roles struct {
+	enabled     bool
+	users       map[string]role
+	defaultRole role
+}
+
+// role returns full access for everybody when there are no users configured,
+// admin api is available for configured admin users only
+func (r *roles) role(user string) role {
+	if !r.enabled {
+		return roleFull
+	}
+
+	if ur, ok := r.users[user]; ok {
+		return ur
+	}
+
+	return r.defaultRole
+}
@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	MethodListAddressees = "list_addressees"
+	MethodAddDevice      = "add_device"
+	MethodRegisterDevice = "register_device"
+	MethodBellAck        = "bell_ack"
+	MethodTrigger        = "trigger"
+	MethodLive           = "live"
+	MethodMode           = "mode"
+	MethodAudioOutput    = "audiooutput"
+	MethodPing           = "ping"
+	MethodPong           = "pong"
+
+	// non-standard methods, they are supported ONLY by mobell application
+	MethodSuppress        = "suppress"
+	MethodSubscribeEvents = "subscribe_events"
+)
+
+// stream settings used by proxy
+const (
+	ModeMxpeg  = "mxpeg"
+	AudioPcm16 = "pcm16"
+)
+
+// names of register_device events
+const (
+	EventBell = "bell"
+	// non-standard event, it is supported ONLY by mobell application
+	EventSuppress = "suppress"
+)
+
+// Ping is a keep alive notification, client answers with pong
+var Ping = Request{Method: MethodPing}
+
+// ModeParams are mode params: [mode]
+type ModeParams struct {
+	Mode string
+}
+
+func (p ModeParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Mode})
+}
+
+func (p *ModeParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 1, &p.Mode)
+}
+
+// AudioOutputParams are audiooutput params: [format]
+type AudioOutputParams struct {
+	Format string
+}
+
+func (p AudioOutputParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Format})
+}
+
+func (p *AudioOutputParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 1, &p.Format)
+}
+
+// LiveParams are live params: [enabled]
+type LiveParams struct {
+	Enabled bool
+}
+
+func (p LiveParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Enabled})
+}
+
+func (p *LiveParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 1, (*flexBool)(&p.Enabled))
+}
+
+// Addressee is a bell button: [id, name, ...], addressee from camera is encoded as is
+type Addressee struct {
+	Id   int
+	Name string
+	raw  json.RawMessage
+}
+
+func (a Addressee) MarshalJSON() ([]byte, error) {
+	if a.raw != nil {
+		return a.raw, nil
+	}
+
+	return json.Marshal([]interface{}{a.Id, a.Name, ""})
+}
+
+func (a *Addressee) UnmarshalJSON(data []byte) error {
+	if err := decodeArray(data, 1, &a.Id, &a.Name); err != nil {
+		return err
+	}
+
+	a.raw = append(json.RawMessage(nil), data...)
+
+	return nil
+}
+
+// ListAddresseesResult is a list_addressees result
+type ListAddresseesResult []Addressee
+
+// AddDeviceParams are add_device params: [mac, [addressee ids], name]
+type AddDeviceParams struct {
+	Mac        string
+	Addressees []int
+	Name       string
+}
+
+func (p AddDeviceParams) MarshalJSON() ([]byte, error) {
+	ids := p.Addressees
+	if ids == nil {
+		ids = []int{}
+	}
+
+	return json.Marshal([]interface{}{p.Mac, ids, p.Name})
+}
+
+func (p *AddDeviceParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 2, &p.Mac, &p.Addressees, &p.Name)
+}
+
+// RegisterDeviceParams are register_device params: [mac].
+// Camera sends events as continuation of register_device request.
+type RegisterDeviceParams struct {
+	Mac string
+}
+
+func (p RegisterDeviceParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Mac})
+}
+
+func (p *RegisterDeviceParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 1, &p.Mac)
+}
+
+// DeviceEvent is a register_device continuation result: [name, params...]
+type DeviceEvent struct {
+	Name   string
+	Params []json.RawMessage
+}
+
+func (e DeviceEvent) MarshalJSON() ([]byte, error) {
+	a := make([]interface{}, 0, len(e.Params)+1)
+	a = append(a, e.Name)
+	for _, p := range e.Params {
+		a = append(a, p)
+	}
+
+	return json.Marshal(a)
+}
+
+func (e *DeviceEvent) UnmarshalJSON(data []byte) error {
+	var a []json.RawMessage
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	if len(a) == 0 {
+		return errors.New("empty event")
+	}
+	if err := json.Unmarshal(a[0], &e.Name); err != nil {
+		return fmt.Errorf("event name: %w", err)
+	}
+
+	e.Params = a[1:]
+
+	return nil
+}
+
+// Bell is a bell event: ["bell", ringing, stopped, addressee]
+type Bell struct {
+	Ringing   bool
+	Addressee *Addressee
+}
+
+func (b Bell) MarshalJSON() ([]byte, error) {
+	a := []interface{}{EventBell, b.Ringing, !b.Ringing}
+	if b.Addressee != nil {
+		a = append(a, b.Addressee)
+	}
+
+	return json.Marshal(a)
+}
+
+func (b *Bell) UnmarshalJSON(data []byte) error {
+	var name string
+	var stopped flexBool
+	if err := decodeArray(data, 2, &name, (*flexBool)(&b.Ringing), &stopped, &b.Addressee); err != nil {
+		return err
+	}
+
+	if name != EventBell {
+		return fmt.Errorf("unexpected event '%s'", name)
+	}
+
+	return nil
+}
+
+// BellAckParams are bell_ack params: [accepted]
+type BellAckParams struct {
+	Ack bool
+}
+
+func (p BellAckParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Ack})
+}
+
+func (p *BellAckParams) UnmarshalJSON(data []byte) error {
+	return decodeArray(data, 1, (*flexBool)(&p.Ack))
+}
+
+// TriggerParams are trigger params: [output]
+type TriggerParams struct {
+	Output string
+}
+
+func (p TriggerParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Output})
+}
+
+func (p *TriggerParams) UnmarshalJSON(data []byte) error {
+	var a []json.RawMessage
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	if len(a) != 1 {
+		return fmt.Errorf("expected 1 param, got %d", len(a))
+	}
+
+	if err := decodeArray(data, 1, &p.Output); err != nil {
+		return err
+	}
+	if p.Output == "" {
+		return errors.New("empty output")
+	}
+
+	return nil
+}
+
+// decodeArray decodes positional params to fields, at least min params are required,
+// missing optional params and extra params are ignored
+func decodeArray(data []byte, min int, fields ...interface{}) error {
+	var a []json.RawMessage
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	if len(a) < min {
+		return fmt.Errorf("expected at least %d params, got %d", min, len(a))
+	}
+
+	for i, f := range fields {
+		if i >= len(a) {
+			break
+		}
+
+		if err := json.Unmarshal(a[i], f); err != nil {
+			return fmt.Errorf("param %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// flexBool accepts "true" and "false" strings, some clients send booleans as strings
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		switch s {
+		case "true":
+			*b = true
+			return nil
+		case "false":
+			*b = false
+			return nil
+		}
+	}
+
+	return json.Unmarshal(data, (*bool)(b))
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// json messages are sent in APP12 segments by camera and proxy and as lines ending with "\n\0" by clients
+const (
+	app12Marker = 0xec
+	// segment length includes two length bytes
+	maxApp12Size = 0xffff - 2
+)
+
+// TypeCont marks continuation response, more responses with the same id may follow
+const TypeCont = "cont"
+
+var ErrTooLarge = errors.New("protocol: message is too large")
+
+// Message is a decoded message in any direction: request or notification has method,
+// response has result or error.
+type Message struct {
+	Id     int             `json:"id"`
+	Type   string          `json:"type,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// Request is an outgoing request, notifications have no id
+type Request struct {
+	Id     int         `json:"id,omitempty"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// Response is an outgoing response, error is nil on success
+type Response struct {
+	Id     int         `json:"id"`
+	Type   string      `json:"type,omitempty"`
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+}
+
+// DecodeError is returned for messages which can't be decoded, it may be reported to sender
+type DecodeError struct {
+	// method of request or response, empty when message itself is malformed
+	Method string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Method == "" {
+		return "protocol: invalid message: " + e.Err.Error()
+	}
+
+	return fmt.Sprintf("protocol: invalid %s: %v", e.Method, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decode decodes message without framing
+func Decode(data []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+
+	return &m, nil
+}
+
+// Failed returns true when message is a response with error
+func (m *Message) Failed() bool {
+	return len(m.Error) > 0 && string(m.Error) != "null"
+}
+
+// DecodeParams decodes request params
+func (m *Message) DecodeParams(v interface{}) error {
+	return decode(m.Method, m.Params, v)
+}
+
+// DecodeResult decodes result of response to request with given method
+func (m *Message) DecodeResult(method string, v interface{}) error {
+	return decode(method, m.Result, v)
+}
+
+func decode(method string, data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		data = json.RawMessage("null")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return &DecodeError{Method: method, Err: err}
+	}
+
+	return nil
+}
+
+func Result(id int, result interface{}) Response {
+	return Response{Id: id, Result: result}
+}
+
+func Fail(id int, err interface{}) Response {
+	return Response{Id: id, Error: err}
+}
+
+func Cont(id int, result interface{}) Response {
+	return Response{Id: id, Type: TypeCont, Result: result}
+}
+
+// EncodeApp12 encodes message to APP12 segment
+func EncodeApp12(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > maxApp12Size {
+		return nil, ErrTooLarge
+	}
+
+	l := len(b) + 2
+
+	data := make([]byte, l+2)
+	data[0] = 0xff
+	data[1] = app12Marker
+	data[2] = byte(l >> 8)
+	data[3] = byte(l)
+	copy(data[4:], b)
+
+	return data, nil
+}
+
+// EncodeLine encodes message to line ending with "\n\0"
+func EncodeLine(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, 0x0a, 0), nil
+}
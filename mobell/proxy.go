@@ -0,0 +1,405 @@
+package mobell
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/apex/log"
+	"mobell-proxy/mobell/auth"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"mobell-proxy/mobell/history"
+	"mobell-proxy/mobell/mqtt"
+	"mobell-proxy/mobell/webhook"
+	"reflect"
+	"sync"
+)
+
+var errUnknownCamera = errors.New("unknown camera")
+
+// event bus subscriber keys
+const (
+	busWebhooks = "webhooks"
+	busMqtt     = "mqtt"
+	busHistory  = "history"
+)
+
+// Proxy holds servers for all configured cameras and shared listener.
+// Clients on shared listener select camera with /door/<name> request path,
+// first configured camera is used when path has no camera prefix.
+type Proxy struct {
+	mu       sync.Mutex
+	listener *listener
+	http     *httpServer
+	httpCfg  config.HTTP
+	recCfg   config.Recording
+	passCfg  config.Passthrough
+	rtsp     *rtspServer
+	servers  map[string]*Server
+	names    []string
+	auth     *auth.Authenticator
+	roles    *roles
+	certs    *certStore
+
+	// events are published to bus from server loops without proxy lock,
+	// integrations are subscribed to bus
+	bus      *event.Bus
+	webhooks *webhook.Dispatcher
+	hookCfg  []config.Webhook
+	mqtt     *mqtt.Bridge
+	mqttCfg  config.MQTT
+	history  *history.Store
+	histCfg  config.History
+
+	runCtx    context.Context
+	runCancel context.CancelFunc
+}
+
+func NewProxy() *Proxy {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Proxy{
+		servers:   make(map[string]*Server),
+		bus:       event.NewBus(),
+		runCtx:    ctx,
+		runCancel: cancel,
+	}
+}
+
+func (p *Proxy) Start(cfg *config.Config, mac string) error {
+	if err := p.Reload(cfg, mac); err != nil {
+		p.Stop()
+		return err
+	}
+
+	go p.runRetention()
+
+	return nil
+}
+
+// Reload starts new cameras, stops removed ones and applies config to running cameras
+func (p *Proxy) Reload(cfg *config.Config, mac string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+
+	// webhooks are restarted only on changes, so pending deliveries are not interrupted
+	var webhooks *webhook.Dispatcher
+	if p.webhooks == nil || !reflect.DeepEqual(p.hookCfg, cfg.Webhooks) {
+		if webhooks, err = webhook.New(cfg.Webhooks); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.TLS.Enabled() {
+		p.certs = nil
+	} else if p.certs == nil || p.certs.cfg != cfg.TLS {
+		certs, err := newCertStore(cfg.TLS)
+		if err != nil {
+			if webhooks != nil {
+				webhooks.Stop()
+			}
+			return err
+		}
+		p.certs = certs
+	}
+
+	if webhooks != nil {
+		p.bus.Subscribe(busWebhooks, webhooks, nil)
+		if p.webhooks != nil {
+			p.webhooks.Stop()
+		}
+		p.webhooks = webhooks
+		p.hookCfg = cfg.Webhooks
+	}
+
+	// history is opened before cameras to catch first events
+	if e := p.openHistory(cfg.History); e != nil {
+		log.WithError(e).Error("error opening history")
+		err = e
+	}
+
+	users := make([]auth.User, 0, len(cfg.Auth.Users))
+	r := &roles{
+		enabled:     len(cfg.Auth.Users) > 0 || cfg.TLS.ClientCA != "",
+		users:       make(map[string]role),
+		defaultRole: roleNames[cfg.Auth.DefaultRole],
+	}
+	for _, u := range cfg.Auth.Users {
+		users = append(users, auth.User{Name: u.Name, Hash: u.Hash})
+		if u.Role != "" {
+			r.users[u.Name] = roleNames[u.Role]
+		}
+	}
+	p.auth = auth.New(cfg.Auth.Realm, users)
+	p.roles = r
+
+	servers := make(map[string]*Server)
+	names := make([]string, 0, len(cfg.Cameras))
+
+	for i := range cfg.Cameras {
+		c := &cfg.Cameras[i]
+
+		s, ok := p.servers[c.Name]
+		if ok {
+			delete(p.servers, c.Name)
+			s.configureOutputs(cfg)
+			if e := s.Reload(c, cfg.KeepAlive, mac); e != nil {
+				s.log.WithError(e).Error("error applying config")
+				err = e
+			}
+		} else {
+			s = New(p, c, cfg.KeepAlive, mac)
+			s.configureOutputs(cfg)
+			if e := s.Start(c.Listen); e != nil {
+				s.log.WithError(e).Error("error starting camera")
+				err = e
+				continue
+			}
+			s.log.Info("camera started")
+		}
+
+		servers[c.Name] = s
+		names = append(names, c.Name)
+	}
+
+	// stop removed cameras
+	for _, s := range p.servers {
+		s.Stop()
+	}
+
+	p.servers = servers
+	p.names = names
+
+	if e := p.listen(cfg.Listen); e != nil {
+		err = e
+	}
+
+	if e := p.listenHttp(cfg.HTTP.Listen); e != nil {
+		err = e
+	}
+	p.httpCfg = cfg.HTTP
+	p.recCfg = cfg.Recording
+	p.passCfg = cfg.Passthrough
+
+	if e := p.listenRtsp(cfg.RTSP.Listen); e != nil {
+		err = e
+	}
+
+	p.startMqtt(cfg.MQTT)
+
+	return err
+}
+
+func (p *Proxy) listen(addr string) error {
+	old := p.listener
+	if old != nil && old.addr == addr {
+		return nil
+	}
+
+	if addr != "" {
+		l, err := listen(p.runCtx, addr, p, p)
+		if err != nil {
+			return err
+		}
+
+		log.WithField("addr", addr).Info("listening")
+		p.listener = l
+	} else {
+		p.listener = nil
+	}
+
+	if old != nil {
+		old.close()
+	}
+
+	return nil
+}
+
+func (p *Proxy) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listener != nil {
+		p.listener.close()
+		p.listener = nil
+	}
+
+	if p.http != nil {
+		_ = p.http.srv.Close()
+		p.http = nil
+	}
+
+	if p.rtsp != nil {
+		_ = p.rtsp.ln.Close()
+		p.rtsp = nil
+	}
+
+	p.runCancel()
+
+	for _, s := range p.servers {
+		s.Stop()
+	}
+
+	p.servers = make(map[string]*Server)
+	p.names = nil
+
+	p.bus.Unsubscribe(busWebhooks)
+	if p.webhooks != nil {
+		p.webhooks.Stop()
+		p.webhooks = nil
+	}
+
+	p.startMqtt(config.MQTT{})
+	_ = p.openHistory(config.History{})
+}
+
+// startMqtt restarts mqtt bridge if config is changed, must be called with proxy lock
+func (p *Proxy) startMqtt(cfg config.MQTT) {
+	if p.mqtt != nil && p.mqttCfg == cfg {
+		return
+	}
+
+	var b *mqtt.Bridge
+	if cfg.Broker != "" {
+		b = mqtt.New(cfg, mqttBackend{p: p})
+	}
+
+	if b != nil {
+		p.bus.Subscribe(busMqtt, b, nil)
+	} else {
+		p.bus.Unsubscribe(busMqtt)
+	}
+
+	old := p.mqtt
+	p.mqtt = b
+	p.mqttCfg = cfg
+
+	if old != nil {
+		old.Stop()
+	}
+
+	if b != nil {
+		b.Start()
+	}
+}
+
+// openHistory reopens history store if config is changed, must be called with proxy lock
+func (p *Proxy) openHistory(cfg config.History) error {
+	if p.history != nil && reflect.DeepEqual(p.histCfg, cfg) {
+		return nil
+	}
+
+	p.bus.Unsubscribe(busHistory)
+	old := p.history
+	p.history = nil
+	p.histCfg = config.History{}
+
+	// database is locked, so old store should be closed first
+	if old != nil {
+		old.Close()
+	}
+
+	if cfg.Path == "" {
+		return nil
+	}
+
+	h, err := history.Open(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.bus.Subscribe(busHistory, h, nil)
+	p.history = h
+	p.histCfg = cfg
+
+	return nil
+}
+
+func (p *Proxy) historyStore() *history.Store {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.history
+}
+
+// publish sends event to event bus
+func (p *Proxy) publish(e event.Event) {
+	p.bus.Publish(e)
+}
+
+func (p *Proxy) server(name string) *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.servers[name]
+}
+
+func (p *Proxy) route(path string) (*Server, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name, rest, ok := splitCameraPath(path)
+	if ok {
+		return p.servers[name], rest
+	}
+
+	if len(p.names) == 0 {
+		return nil, path
+	}
+
+	return p.servers[p.names[0]], path
+}
+
+func (p *Proxy) authenticator() *auth.Authenticator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.auth
+}
+
+func (p *Proxy) httpConfig() config.HTTP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.httpCfg
+}
+
+func (p *Proxy) recordingConfig() config.Recording {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.recCfg
+}
+
+func (p *Proxy) tlsConfig() *tls.Config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.certs == nil {
+		return nil
+	}
+
+	return p.certs.config()
+}
+
+func (p *Proxy) userRole(user string) role {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.roles.role(user)
+}
+
+// serverList returns servers in config order
+func (p *Proxy) serverList() []*Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := make([]*Server, 0, len(p.names))
+	for _, name := range p.names {
+		servers = append(servers, p.servers[name])
+	}
+
+	return servers
+}
@@ -0,0 +1,60 @@
+package recorder
+
+import (
+	"time"
+)
+
+type Packet struct {
+	Data []byte
+	// key frame, clips always start with it
+	Key  bool
+	Time time.Time
+}
+
+// Buffer keeps last packets for pre-roll, it always starts with key frame
+type Buffer struct {
+	duration time.Duration
+	packets  []Packet
+}
+
+func NewBuffer(duration time.Duration) *Buffer {
+	return &Buffer{duration: duration}
+}
+
+func (b *Buffer) SetDuration(duration time.Duration) {
+	b.duration = duration
+}
+
+func (b *Buffer) Add(p Packet) {
+	// nothing can be decoded without key frame
+	if len(b.packets) == 0 && !p.Key {
+		return
+	}
+
+	b.packets = append(b.packets, p)
+
+	// keep last key frame which is older than pre-roll duration
+	limit := p.Time.Add(-b.duration)
+	start := 0
+	for i, pk := range b.packets {
+		if pk.Time.After(limit) {
+			break
+		}
+		if pk.Key {
+			start = i
+		}
+	}
+
+	if start > 0 {
+		b.packets = append([]Packet(nil), b.packets[start:]...)
+	}
+}
+
+// Packets returns buffered packets starting with key frame
+func (b *Buffer) Packets() []Packet {
+	return append([]Packet(nil), b.packets...)
+}
+
+func (b *Buffer) Reset() {
+	b.packets = nil
+}
@@ -0,0 +1,131 @@
+package recorder
+
+import (
+	"context"
+	"github.com/apex/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// number of packets waiting for writing, new packets are dropped on overflow
+const queueSize = 1024
+
+// max time for mp4 conversion
+const convertTimeout = time.Minute * 10
+
+// Clip writes raw mxpeg stream to file in background
+type Clip struct {
+	Path string
+
+	f     *os.File
+	queue chan []byte
+	log   log.Interface
+}
+
+func NewClip(path string, l log.Interface) (*Clip, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clip{
+		Path:  path,
+		f:     f,
+		queue: make(chan []byte, queueSize),
+		log:   l.WithField("clip", path),
+	}, nil
+}
+
+// Write queues data for writing
+func (c *Clip) Write(data []byte) {
+	select {
+	case c.queue <- data:
+	default:
+		c.log.Warn("queue is full, dropping packet")
+	}
+}
+
+// Start starts writing, done is called after file is closed
+func (c *Clip) Start(done func()) {
+	go func() {
+		failed := false
+
+		for data := range c.queue {
+			if failed {
+				continue
+			}
+
+			if _, err := c.f.Write(data); err != nil {
+				c.log.WithError(err).Error("error writing clip")
+				failed = true
+			}
+		}
+
+		if err := c.f.Close(); err != nil {
+			c.log.WithError(err).Error("error closing clip")
+		}
+
+		c.log.Info("clip saved")
+
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// Close finishes writing of queued packets
+func (c *Clip) Close() {
+	close(c.queue)
+}
+
+// ConvertMp4 converts mxg clip to mp4 with ffmpeg, mxg file is removed unless keep is set
+func ConvertMp4(ffmpeg string, path string, keep bool) (string, error) {
+	out := strings.TrimSuffix(path, filepath.Ext(path)) + ".mp4"
+
+	ctx, cancel := context.WithTimeout(context.Background(), convertTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-y", "-loglevel", "error",
+		"-f", "mxg", "-i", path,
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		out,
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(out)
+		if len(output) > 0 {
+			return "", &ConvertError{err: err, output: strings.TrimSpace(string(output))}
+		}
+		return "", err
+	}
+
+	if !keep {
+		if err := os.Remove(path); err != nil {
+			return out, err
+		}
+	}
+
+	return out, nil
+}
+
+type ConvertError struct {
+	err    error
+	output string
+}
+
+func (e *ConvertError) Error() string {
+	return e.err.Error() + ": " + e.output
+}
+
+func (e *ConvertError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,94 @@
+package recorder
+
+import (
+	"github.com/apex/log"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// files modified recently may be still written or converted
+const activeClipTime = time.Minute
+
+var cleanupMu sync.Mutex
+
+type clipFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Cleanup removes clips older than maxAge and oldest clips while total size is bigger than maxSize,
+// zero values mean no limit
+func Cleanup(dir string, maxAge time.Duration, maxSize int64) error {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+
+	var files []clipFile
+	var total int64
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		switch filepath.Ext(path) {
+		case ".mxg", ".mp4":
+		default:
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, clipFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now := time.Now()
+
+	for _, f := range files {
+		if now.Sub(f.modTime) < activeClipTime {
+			break
+		}
+
+		expired := maxAge > 0 && now.Sub(f.modTime) > maxAge
+		tooBig := maxSize > 0 && total > maxSize
+
+		if !expired && !tooBig {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.WithError(err).WithField("clip", f.path).Warn("error removing clip")
+			continue
+		}
+
+		log.WithField("clip", f.path).Info("clip removed")
+		total -= f.size
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package mobell
+
+import (
+	"github.com/apex/log"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/mxpeg"
+	"mobell-proxy/mobell/recorder"
+	"path/filepath"
+	"time"
+)
+
+// camera may send key frames rarely, so we're generating them for pre-roll buffer
+const recordingKeyInterval = time.Second * 2
+
+// how often old clips are removed
+const retentionInterval = time.Hour
+
+const megabyte = 1024 * 1024
+
+type recording struct {
+	clip  *recorder.Clip
+	start time.Time
+	end   time.Time
+	timer *time.Timer
+}
+
+// record adds packet to pre-roll buffer and active clip, must be called from server loop
+func (s *Server) record(data []byte, video bool, key bool) {
+	cfg := s.recordingConfig()
+	if cfg.Dir == "" {
+		return
+	}
+
+	s.preroll.SetDuration(cfg.PreRoll)
+
+	now := time.Now()
+
+	if video {
+		if key {
+			s.lastKey = now
+			s.recPatch = false
+		} else if now.Sub(s.lastKey) >= recordingKeyInterval {
+			// decoded picture already includes this frame, so it is replaced with key frame
+			if frame := s.codec.EncodeFrame(); frame != nil {
+				s.lastKey = now
+				s.recPatch = true
+				data, key = frame, true
+			}
+		} else if s.recPatch {
+			s.recPatch = false
+			data = mxpeg.PatchDqtDht(data, s.dqt, s.dht)
+		}
+	}
+
+	s.preroll.Add(recorder.Packet{Data: data, Key: key, Time: now})
+
+	if s.rec != nil {
+		s.rec.clip.Write(data)
+	}
+}
+
+// startRecording starts new clip or extends current one, must be called from server loop
+func (s *Server) startRecording() {
+	cfg := s.recordingConfig()
+	if cfg.Dir == "" {
+		return
+	}
+
+	now := time.Now()
+
+	if s.rec != nil {
+		s.extendRecording(now.Add(cfg.PostRoll))
+		return
+	}
+
+	path := filepath.Join(cfg.Dir, s.name, now.Format("20060102-150405")+".mxg")
+
+	clip, err := recorder.NewClip(path, s.log)
+	if err != nil {
+		s.log.WithError(err).Error("error creating clip")
+		return
+	}
+
+	s.log.WithField("clip", path).Info("recording started")
+
+	for _, p := range s.preroll.Packets() {
+		clip.Write(p.Data)
+	}
+
+	clip.Start(func() {
+		postProcess(clip.Path, cfg)
+	})
+
+	s.rec = &recording{clip: clip, start: now}
+	s.extendRecording(now.Add(cfg.PostRoll))
+}
+
+// answerRecording finishes clip after tail when bell is answered, must be called from server loop
+func (s *Server) answerRecording() {
+	if s.rec == nil {
+		return
+	}
+
+	s.extendRecording(time.Now().Add(s.recordingConfig().Tail))
+}
+
+// extendRecording sets new clip end, must be called from server loop
+func (s *Server) extendRecording(end time.Time) {
+	rec := s.rec
+
+	if maxEnd := rec.start.Add(s.recordingConfig().MaxDuration); end.After(maxEnd) {
+		end = maxEnd
+	}
+	rec.end = end
+
+	d := time.Until(end)
+	if rec.timer == nil {
+		rec.timer = time.AfterFunc(d, func() {
+			s.exec(s.checkRecording)
+		})
+	} else {
+		rec.timer.Reset(d)
+	}
+}
+
+func (s *Server) checkRecording() {
+	if s.rec == nil {
+		return
+	}
+
+	if d := time.Until(s.rec.end); d > 0 {
+		s.rec.timer.Reset(d)
+		return
+	}
+
+	s.stopRecording()
+}
+
+func (s *Server) stopRecording() {
+	rec := s.rec
+	s.rec = nil
+
+	if rec.timer != nil {
+		rec.timer.Stop()
+	}
+
+	s.log.WithField("clip", rec.clip.Path).Info("recording finished")
+	rec.clip.Close()
+}
+
+// postProcess converts clip and applies retention limits
+func postProcess(path string, cfg config.Recording) {
+	l := log.WithField("clip", path)
+
+	if cfg.Mp4 {
+		out, err := recorder.ConvertMp4(cfg.Ffmpeg, path, cfg.KeepMxg)
+		if err != nil {
+			l.WithError(err).Error("error converting clip to mp4")
+		} else {
+			l.WithField("mp4", out).Info("clip converted")
+		}
+	}
+
+	applyRetention(cfg)
+}
+
+func applyRetention(cfg config.Recording) {
+	if cfg.Dir == "" || (cfg.MaxAge == 0 && cfg.MaxSize == 0) {
+		return
+	}
+
+	if err := recorder.Cleanup(cfg.Dir, cfg.MaxAge, cfg.MaxSize*megabyte); err != nil {
+		log.WithError(err).Warn("error removing old clips")
+	}
+}
+
+// runRetention periodically removes old clips
+func (p *Proxy) runRetention() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		applyRetention(p.recordingConfig())
+
+		select {
+		case <-p.runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package mobell
+
+import (
+	"mobell-proxy/mobell/event"
+	"time"
+)
+
+// ringState is a current bell state, it is accessed from server loop only
+type ringState struct {
+	ringing bool
+	start   time.Time
+	// last ring or bell stop event from camera
+	last time.Time
+	// bell button of current or last ring
+	addressee *addressee
+	// response to the last ring
+	answer *ringAnswer
+	timer  *time.Timer
+}
+
+type ringAnswer struct {
+	Type   event.Type `json:"type"`
+	User   string     `json:"user,omitempty"`
+	Client string     `json:"client,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// bell updates ring state and sends bell event to subscribed clients, must be called from server loop
+func (s *Server) bell(isRing bool, a *addressee) {
+	now := time.Now()
+	r := &s.ring
+
+	if isRing {
+		if !r.ringing {
+			r.start = now
+			r.answer = nil
+		}
+		s.startRingTimer()
+	} else if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	r.ringing = isRing
+	r.last = now
+	r.addressee = a
+
+	for e := s.conns.Front(); e != nil; e = e.Next() {
+		e.Value.(*connection).sendBell(isRing, a)
+	}
+}
+
+// answer stops ringing on client response, conn may be nil for commands from mqtt or api
+func (s *Server) answer(t event.Type, conn *connection) {
+	r := &s.ring
+
+	if r.ringing {
+		a := &ringAnswer{Type: t, Time: time.Now()}
+		if conn != nil {
+			a.User = conn.user
+			a.Client = conn.remoteAddr
+		}
+		r.answer = a
+	}
+
+	r.ringing = false
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// startRingTimer clears ringing when camera doesn't send bell stop, must be called from server loop
+func (s *Server) startRingTimer() {
+	timeout := s.getRingTimeout()
+
+	if s.ring.timer != nil {
+		s.ring.timer.Reset(timeout)
+		return
+	}
+
+	s.ring.timer = time.AfterFunc(timeout, func() {
+		s.exec(func() {
+			r := &s.ring
+			if !r.ringing {
+				return
+			}
+
+			// timeout may be changed on reload
+			if d := s.getRingTimeout() - time.Since(r.last); d > 0 {
+				r.timer.Reset(d)
+				return
+			}
+
+			s.log.WithField("start", r.start).Warn("camera didn't stop ringing, clearing ring state")
+			a := s.ringAddressee()
+			e := s.event(event.BellStop, nil)
+			e.Addressee = &a.Addressee
+			s.proxy.publish(e)
+			s.bell(false, a)
+		})
+	})
+}
+
+// sendRingState sends current bell state to newly registered client, must be called from server loop
+func (s *Server) sendRingState(conn *connection) {
+	if s.ring.ringing {
+		conn.sendBell(true, s.ring.addressee)
+	}
+}
@@ -0,0 +1,351 @@
+package mobell
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/apex/log"
+	"mobell-proxy/mobell/auth"
+	"mobell-proxy/mobell/rtsp"
+	"mobell-proxy/mobell/stream"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clients should send keepalive requests or rtcp reports within this interval
+const rtspSessionTimeout = time.Second * 60
+
+// how long DESCRIBE waits for first h264 key frame to include parameter sets into sdp
+const rtspParamsTimeout = time.Second * 3
+
+const rtspTrackPrefix = "/trackID="
+
+type rtspServer struct {
+	addr string
+	ln   net.Listener
+}
+
+// listenRtsp (re)starts rtsp server, must be called with proxy lock
+func (p *Proxy) listenRtsp(addr string) error {
+	old := p.rtsp
+	if old != nil && old.addr == addr {
+		return nil
+	}
+
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		srv := &rtspServer{addr: addr, ln: ln}
+		go p.acceptRtsp(srv)
+
+		log.WithField("addr", addr).Info("rtsp listening")
+		p.rtsp = srv
+	} else {
+		p.rtsp = nil
+	}
+
+	if old != nil {
+		_ = old.ln.Close()
+	}
+
+	return nil
+}
+
+func (p *Proxy) acceptRtsp(srv *rtspServer) {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			log.WithField("addr", srv.addr).Debug("finished accepting new rtsp connections")
+			return
+		}
+
+		setKeepalive(conn)
+
+		addr := conn.RemoteAddr().String()
+		l := log.WithField("rtsp", addr)
+
+		str := stream.NewStream(p.runCtx, conn, l)
+		str.ReadTimeout = rtspSessionTimeout
+
+		c := &rtspConn{
+			proxy: p,
+			str:   str,
+			log:   l,
+		}
+
+		go c.run()
+	}
+}
+
+type rtspConn struct {
+	proxy *Proxy
+	str   *stream.Stream
+	user  string
+	authn bool
+
+	// connection serves single camera session
+	server  *Server
+	session *rtsp.Session
+	playing bool
+
+	log log.Interface
+}
+
+func (c *rtspConn) run() {
+	defer func() {
+		c.release()
+		c.str.Close()
+	}()
+
+	r := bufio.NewReader(c.str)
+
+	for {
+		req, err := rtsp.ReadRequest(r)
+		if err != nil {
+			c.log.WithError(err).Debug("rtsp connection finished")
+			return
+		}
+
+		c.log.WithField("method", req.Method).WithField("uri", req.URI).Debug("rtsp request")
+
+		if resp := c.handle(req); resp != nil {
+			_, _ = c.str.Write(resp.Bytes(req))
+		}
+	}
+}
+
+// handle returns nil when response is already sent
+func (c *rtspConn) handle(req *rtsp.Request) *rtsp.Response {
+	if req.Method == "OPTIONS" {
+		resp := rtsp.NewResponse(rtsp.StatusOK)
+		resp.Header.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER")
+		return resp
+	}
+
+	if resp := c.authenticate(req); resp != nil {
+		return resp
+	}
+
+	switch req.Method {
+	case "DESCRIBE":
+		return c.describe(req)
+	case "SETUP":
+		return c.setup(req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN":
+		if resp := c.checkSession(req); resp != nil {
+			return resp
+		}
+		c.release()
+		return rtsp.NewResponse(rtsp.StatusOK)
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// keepalive
+		return rtsp.NewResponse(rtsp.StatusOK)
+	default:
+		return rtsp.NewResponse(rtsp.StatusNotImplemented)
+	}
+}
+
+// authenticate returns error response when client is not authenticated
+func (c *rtspConn) authenticate(req *rtsp.Request) *rtsp.Response {
+	if c.authn {
+		return nil
+	}
+
+	a := c.proxy.authenticator()
+	if !a.Enabled() {
+		c.authn = true
+		return nil
+	}
+
+	user, err := a.Check(req.Method, req.URI, req.Header.Get("Authorization"))
+	if err == nil {
+		c.authn = true
+		c.user = user
+		c.log = c.log.WithField("user", user)
+		return nil
+	}
+
+	if err != auth.ErrNoCredentials {
+		c.log.WithError(err).Warn("authentication failed")
+	}
+
+	resp := rtsp.NewResponse(rtsp.StatusUnauthorized)
+	for _, h := range a.Challenge(err == auth.ErrStaleNonce) {
+		resp.Header.Add("WWW-Authenticate", h)
+	}
+
+	return resp
+}
+
+// route finds camera for request uri and returns track id or -1 for aggregate uri
+func (c *rtspConn) route(req *rtsp.Request) (*Server, int) {
+	u, err := url.Parse(req.URI)
+	if err != nil {
+		return nil, -1
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	track := -1
+
+	if i := strings.LastIndex(path, rtspTrackPrefix); i >= 0 {
+		t, err := strconv.Atoi(path[i+len(rtspTrackPrefix):])
+		if err != nil || (t != rtsp.VideoTrack && t != rtsp.AudioTrack) {
+			return nil, -1
+		}
+		path, track = path[:i], t
+	}
+
+	s, _ := c.proxy.route(path)
+
+	return s, track
+}
+
+// acquire starts using camera stream, previous camera is released
+func (c *rtspConn) acquire(s *Server) bool {
+	if c.server == s {
+		return true
+	}
+
+	c.release()
+
+	if s.rtsp.Acquire() != nil {
+		return false
+	}
+
+	c.server = s
+	c.log = c.log.WithField("camera", s.name)
+
+	return true
+}
+
+func (c *rtspConn) release() {
+	if c.server == nil {
+		return
+	}
+
+	if c.session != nil {
+		c.server.rtsp.Stop(c.session)
+		c.session = nil
+		c.playing = false
+	}
+
+	c.server.rtsp.Release()
+	c.server = nil
+}
+
+func (c *rtspConn) checkSession(req *rtsp.Request) *rtsp.Response {
+	id := strings.TrimSpace(strings.SplitN(req.Header.Get("Session"), ";", 2)[0])
+	if c.session == nil || id != c.session.Id {
+		return rtsp.NewResponse(rtsp.StatusSessionNotFound)
+	}
+
+	return nil
+}
+
+func (c *rtspConn) describe(req *rtsp.Request) *rtsp.Response {
+	s, _ := c.route(req)
+	if s == nil {
+		return rtsp.NewResponse(rtsp.StatusNotFound)
+	}
+
+	if !s.client.Connected() || !c.acquire(s) {
+		return rtsp.NewResponse(rtsp.StatusServiceUnavailable)
+	}
+
+	if !s.rtsp.WaitParams(rtspParamsTimeout) {
+		c.log.Warn("no h264 parameter sets yet")
+	}
+
+	base := req.URI
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	resp := rtsp.NewResponse(rtsp.StatusOK)
+	resp.Header.Set("Content-Type", "application/sdp")
+	resp.Header.Set("Content-Base", base)
+	resp.Body = s.rtsp.SDP()
+
+	return resp
+}
+
+func (c *rtspConn) setup(req *rtsp.Request) *rtsp.Response {
+	s, track := c.route(req)
+	if s == nil || track < 0 {
+		return rtsp.NewResponse(rtsp.StatusNotFound)
+	}
+
+	// only interleaved tcp transport is supported, clients usually fall back to it
+	transport := req.Header.Get("Transport")
+	if !strings.Contains(transport, "RTP/AVP/TCP") {
+		return rtsp.NewResponse(rtsp.StatusUnsupportedTransport)
+	}
+
+	channel := track * 2
+	for _, p := range strings.Split(transport, ";") {
+		if v := strings.TrimPrefix(p, "interleaved="); v != p {
+			ch, err := strconv.Atoi(strings.SplitN(v, "-", 2)[0])
+			if err != nil || ch < 0 || ch > 254 {
+				return rtsp.NewResponse(rtsp.StatusBadRequest)
+			}
+			channel = ch
+		}
+	}
+
+	if c.session != nil {
+		if resp := c.checkSession(req); resp != nil {
+			return resp
+		}
+	}
+
+	if !c.acquire(s) {
+		return rtsp.NewResponse(rtsp.StatusServiceUnavailable)
+	}
+
+	if c.session == nil {
+		c.session = rtsp.NewSession(newSessionId(), c.str)
+	}
+	c.session.Setup(track, channel)
+
+	resp := rtsp.NewResponse(rtsp.StatusOK)
+	resp.Header.Set("Transport", "RTP/AVP/TCP;unicast;interleaved="+strconv.Itoa(channel)+"-"+strconv.Itoa(channel+1))
+	resp.Header.Set("Session", c.session.Id+";timeout="+strconv.Itoa(int(rtspSessionTimeout/time.Second)))
+
+	return resp
+}
+
+func (c *rtspConn) play(req *rtsp.Request) *rtsp.Response {
+	if resp := c.checkSession(req); resp != nil {
+		return resp
+	}
+
+	resp := rtsp.NewResponse(rtsp.StatusOK)
+	resp.Header.Set("Session", c.session.Id)
+	resp.Header.Set("Range", "npt=0.000-")
+
+	// response should be sent before media data
+	_, _ = c.str.Write(resp.Bytes(req))
+
+	if !c.playing {
+		c.log.Info("rtsp playing started")
+		c.server.rtsp.Play(c.session)
+		c.playing = true
+	}
+
+	return nil
+}
+
+func newSessionId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var ErrBadRequest = errors.New("bad request")
+
+const (
+	StatusOK                   = 200
+	StatusBadRequest           = 400
+	StatusUnauthorized         = 401
+	StatusNotFound             = 404
+	StatusSessionNotFound      = 454
+	StatusUnsupportedTransport = 461
+	StatusNotImplemented       = 501
+	StatusServiceUnavailable   = 503
+)
+
+var statusText = map[int]string{
+	StatusOK:                   "OK",
+	StatusBadRequest:           "Bad Request",
+	StatusUnauthorized:         "Unauthorized",
+	StatusNotFound:             "Not Found",
+	StatusSessionNotFound:      "Session Not Found",
+	StatusUnsupportedTransport: "Unsupported Transport",
+	StatusNotImplemented:       "Not Implemented",
+	StatusServiceUnavailable:   "Service Unavailable",
+}
+
+type Request struct {
+	Method string
+	URI    string
+	Header textproto.MIMEHeader
+}
+
+// ReadRequest reads rtsp request, interleaved rtcp packets from client are skipped
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if b[0] != '$' {
+			break
+		}
+
+		// $, channel, length
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return nil, err
+		}
+
+		if _, err := r.Discard(int(binary.BigEndian.Uint16(h[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	f := strings.Fields(line)
+	if len(f) != 3 || !strings.HasPrefix(f[2], "RTSP/1.") {
+		return nil, ErrBadRequest
+	}
+
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// we don't need request body
+	if l := h.Get("Content-Length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return nil, ErrBadRequest
+		}
+
+		if _, err := r.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Request{Method: f[0], URI: f[1], Header: h}, nil
+}
+
+type Response struct {
+	Status int
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+func NewResponse(status int) *Response {
+	return &Response{Status: status, Header: make(textproto.MIMEHeader)}
+}
+
+// Bytes returns encoded response with CSeq of request
+func (r *Response) Bytes(req *Request) []byte {
+	var b strings.Builder
+
+	b.WriteString("RTSP/1.0 " + strconv.Itoa(r.Status) + " " + statusText[r.Status] + "\r\n")
+	b.WriteString("CSeq: " + req.Header.Get("CSeq") + "\r\n")
+
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+
+	if len(r.Body) > 0 {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(r.Body)) + "\r\n")
+	}
+
+	b.WriteString("\r\n")
+	b.Write(r.Body)
+
+	return []byte(b.String())
+}
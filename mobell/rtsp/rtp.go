@@ -0,0 +1,128 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"mobell-proxy/mobell/h264"
+	"time"
+)
+
+// max rtp payload size, so packets fit into ethernet frame
+const maxPayload = 1400
+
+// seconds between 1900 and 1970 for ntp timestamps
+const ntpEpochOffset = 2208988800
+
+type packetizer struct {
+	payloadType byte
+	ssrc        uint32
+	seq         uint16
+
+	// sender report counters
+	packets uint32
+	octets  uint32
+}
+
+func (p *packetizer) packet(payload []byte, ts uint32, marker bool) []byte {
+	b := make([]byte, 12+len(payload))
+
+	b[0] = 0x80
+	b[1] = p.payloadType
+	if marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.seq)
+	binary.BigEndian.PutUint32(b[4:], ts)
+	binary.BigEndian.PutUint32(b[8:], p.ssrc)
+	copy(b[12:], payload)
+
+	p.seq++
+	p.packets++
+	p.octets += uint32(len(payload))
+
+	return b
+}
+
+// h264 packs annex b access unit, big nal units are fragmented with FU-A (rfc 6184)
+func (p *packetizer) h264Packets(au []byte, ts uint32) [][]byte {
+	var packets [][]byte
+
+	nalus := h264.SplitNalUnits(au)
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+
+		if len(nalu) <= maxPayload {
+			packets = append(packets, p.packet(nalu, ts, last))
+			continue
+		}
+
+		indicator := nalu[0]&0xe0 | 28
+		data := nalu[1:]
+
+		for start := true; len(data) > 0; start = false {
+			n := len(data)
+			if n > maxPayload-2 {
+				n = maxPayload - 2
+			}
+
+			header := nalu[0] & 0x1f
+			if start {
+				header |= 0x80
+			}
+
+			end := n == len(data)
+			if end {
+				header |= 0x40
+			}
+
+			payload := make([]byte, 0, n+2)
+			payload = append(payload, indicator, header)
+			payload = append(payload, data[:n]...)
+
+			packets = append(packets, p.packet(payload, ts, last && end))
+			data = data[n:]
+		}
+	}
+
+	return packets
+}
+
+// l16 converts little endian pcm16 samples to network byte order (rfc 3551)
+func (p *packetizer) l16(samples []byte, ts uint32) [][]byte {
+	var packets [][]byte
+
+	for len(samples) >= 2 {
+		n := len(samples) &^ 1
+		if n > maxPayload {
+			n = maxPayload
+		}
+
+		payload := make([]byte, n)
+		for i := 0; i < n; i += 2 {
+			payload[i], payload[i+1] = samples[i+1], samples[i]
+		}
+
+		packets = append(packets, p.packet(payload, ts, false))
+
+		ts += uint32(n / 2)
+		samples = samples[n:]
+	}
+
+	return packets
+}
+
+// senderReport returns rtcp sender report, ts is rtp timestamp corresponding to now
+func (p *packetizer) senderReport(now time.Time, ts uint32) []byte {
+	b := make([]byte, 28)
+
+	b[0] = 0x80
+	b[1] = 200
+	binary.BigEndian.PutUint16(b[2:], 6)
+	binary.BigEndian.PutUint32(b[4:], p.ssrc)
+	binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[12:], uint32((uint64(now.Nanosecond())<<32)/uint64(time.Second)))
+	binary.BigEndian.PutUint32(b[16:], ts)
+	binary.BigEndian.PutUint32(b[20:], p.packets)
+	binary.BigEndian.PutUint32(b[24:], p.octets)
+
+	return b
+}
@@ -0,0 +1,326 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mobell-proxy/mobell/h264"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("stream is closed")
+
+const (
+	VideoTrack = 0
+	AudioTrack = 1
+)
+
+const (
+	videoPayloadType = 96
+	audioPayloadType = 97
+	videoClockRate   = 90000
+)
+
+// how often rtcp sender reports are sent
+const reportInterval = time.Second * 5
+
+// audio timestamps are resynchronized with wall clock when drift is bigger
+const audioMaxDrift = time.Millisecond * 200
+
+// Source provides h264 frames, it is started with first stream reader and stopped after last one
+type Source interface {
+	Start()
+	Stop()
+	RequestKeyFrame()
+}
+
+// Writer is an rtsp client connection
+type Writer interface {
+	Write(data []byte) (int, error)
+	Close()
+}
+
+// Session is an rtsp session with interleaved tcp transport
+type Session struct {
+	Id string
+
+	w Writer
+	// interleaved rtp channels for tracks, rtcp uses next channel, -1 when track is not set up
+	channels [2]int
+	waitKey  bool
+}
+
+func NewSession(id string, w Writer) *Session {
+	return &Session{Id: id, w: w, channels: [2]int{-1, -1}}
+}
+
+func (s *Session) Setup(track int, channel int) {
+	s.channels[track] = channel
+}
+
+func (s *Session) write(channel int, packet []byte) {
+	b := make([]byte, 4+len(packet))
+	b[0] = '$'
+	b[1] = byte(channel)
+	b[2] = byte(len(packet) >> 8)
+	b[3] = byte(len(packet))
+	copy(b[4:], packet)
+
+	_, _ = s.w.Write(b)
+}
+
+// Stream distributes h264 video and l16 audio to rtsp sessions
+type Stream struct {
+	source    Source
+	audioRate int
+	// base for rtp timestamps
+	start time.Time
+
+	mu       sync.Mutex
+	readers  int
+	sessions map[*Session]struct{}
+	closed   bool
+
+	video packetizer
+	audio packetizer
+
+	sps      []byte
+	pps      []byte
+	paramsCh chan struct{}
+
+	// next audio timestamp
+	audioTs     uint32
+	audioSynced bool
+
+	reportTime [2]time.Time
+}
+
+func NewStream(source Source, audioRate int) *Stream {
+	return &Stream{
+		source:    source,
+		audioRate: audioRate,
+		start:     time.Now(),
+		sessions:  make(map[*Session]struct{}),
+		video:     packetizer{payloadType: videoPayloadType, ssrc: rand.Uint32()},
+		audio:     packetizer{payloadType: audioPayloadType, ssrc: rand.Uint32()},
+		paramsCh:  make(chan struct{}),
+	}
+}
+
+// Acquire registers stream reader, source is started for first reader
+func (s *Stream) Acquire() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.readers++
+	first := s.readers == 1
+	s.mu.Unlock()
+
+	if first {
+		s.source.Start()
+	}
+
+	return nil
+}
+
+// Release unregisters stream reader, source is stopped after last reader
+func (s *Stream) Release() {
+	s.mu.Lock()
+	s.readers--
+	last := s.readers == 0 && !s.closed
+	s.mu.Unlock()
+
+	if last {
+		s.source.Stop()
+	}
+}
+
+func (s *Stream) Active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readers > 0 && !s.closed
+}
+
+// Readers returns number of connected readers
+func (s *Stream) Readers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readers
+}
+
+// Close closes all sessions, stream can't be used after closing
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for sess := range s.sessions {
+		sess.w.Close()
+	}
+	s.sessions = make(map[*Session]struct{})
+}
+
+// Play starts sending data to session, video is sent starting with next key frame
+func (s *Stream) Play(sess *Session) {
+	s.mu.Lock()
+	sess.waitKey = true
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+
+	s.source.RequestKeyFrame()
+}
+
+func (s *Stream) Stop(sess *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sess)
+}
+
+func (s *Stream) audioClock(t time.Time) uint32 {
+	return uint32(int64(t.Sub(s.start)) * int64(s.audioRate) / int64(time.Second))
+}
+
+// WriteH264 sends annex b access unit with pts in 90kHz units
+func (s *Stream) WriteH264(au []byte, key bool, pts int64, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key {
+		s.updateParams(au)
+	}
+
+	ts := uint32(pts)
+	packets := s.video.h264Packets(au, ts)
+
+	for sess := range s.sessions {
+		ch := sess.channels[VideoTrack]
+		if ch < 0 {
+			continue
+		}
+
+		if sess.waitKey {
+			if !key {
+				continue
+			}
+			sess.waitKey = false
+		}
+
+		for _, p := range packets {
+			sess.write(ch, p)
+		}
+	}
+
+	s.report(VideoTrack, &s.video, t, ts)
+}
+
+// WriteAudio sends little endian pcm16 samples received at t
+func (s *Stream) WriteAudio(samples []byte, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clock := s.audioClock(t)
+	maxDrift := uint32(int64(s.audioRate) * int64(audioMaxDrift) / int64(time.Second))
+	if drift := int32(clock - s.audioTs); !s.audioSynced || drift > int32(maxDrift) || drift < -int32(maxDrift) {
+		s.audioTs = clock
+		s.audioSynced = true
+	}
+
+	ts := s.audioTs
+	packets := s.audio.l16(samples, ts)
+	s.audioTs += uint32(len(samples) / 2)
+
+	for sess := range s.sessions {
+		ch := sess.channels[AudioTrack]
+		if ch < 0 {
+			continue
+		}
+
+		for _, p := range packets {
+			sess.write(ch, p)
+		}
+	}
+
+	s.report(AudioTrack, &s.audio, t, ts)
+}
+
+// report sends rtcp sender reports, so clients may synchronize tracks, must be called with lock
+func (s *Stream) report(track int, p *packetizer, t time.Time, ts uint32) {
+	if t.Sub(s.reportTime[track]) < reportInterval {
+		return
+	}
+	s.reportTime[track] = t
+
+	sr := p.senderReport(t, ts)
+	for sess := range s.sessions {
+		if ch := sess.channels[track]; ch >= 0 {
+			sess.write(ch+1, sr)
+		}
+	}
+}
+
+// updateParams saves sps and pps from key frame, must be called with lock
+func (s *Stream) updateParams(au []byte) {
+	sps, pps := h264.ParameterSets(h264.SplitNalUnits(au))
+	if sps == nil || pps == nil {
+		return
+	}
+
+	s.sps = append([]byte(nil), sps...)
+	s.pps = append([]byte(nil), pps...)
+
+	select {
+	case <-s.paramsCh:
+	default:
+		close(s.paramsCh)
+	}
+}
+
+// WaitParams waits until sps and pps are known
+func (s *Stream) WaitParams(timeout time.Duration) bool {
+	select {
+	case <-s.paramsCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// SDP returns session description, h264 parameter sets are included when they are known
+func (s *Stream) SDP() []byte {
+	s.mu.Lock()
+	sps, pps := s.sps, s.pps
+	s.mu.Unlock()
+
+	fmtp := "packetization-mode=1"
+	if len(sps) >= 4 && len(pps) > 0 {
+		fmtp += ";profile-level-id=" + strings.ToUpper(hex.EncodeToString(sps[1:4]))
+		fmtp += ";sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(sps) + "," + base64.StdEncoding.EncodeToString(pps)
+	}
+
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN IP4 0.0.0.0", s.start.Unix()),
+		"s=Mobell",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", videoPayloadType),
+		fmt.Sprintf("a=rtpmap:%d H264/%d", videoPayloadType, videoClockRate),
+		fmt.Sprintf("a=fmtp:%d %s", videoPayloadType, fmtp),
+		fmt.Sprintf("a=control:trackID=%d", VideoTrack),
+		fmt.Sprintf("m=audio 0 RTP/AVP %d", audioPayloadType),
+		fmt.Sprintf("a=rtpmap:%d L16/%d/1", audioPayloadType, s.audioRate),
+		fmt.Sprintf("a=control:trackID=%d", AudioTrack),
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
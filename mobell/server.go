@@ -5,9 +5,15 @@ import (
 	"context"
 	"github.com/apex/log"
 	"mobell-proxy/mobell/codec"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"mobell-proxy/mobell/hls"
 	"mobell-proxy/mobell/mxpeg"
-	"net"
-	"syscall"
+	"mobell-proxy/mobell/protocol"
+	"mobell-proxy/mobell/recorder"
+	"mobell-proxy/mobell/rtsp"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,17 +23,26 @@ var audioStopEvt = []byte{
 }
 
 type Server struct {
-	listenAddr   string
+	proxy *Proxy
+	name  string
+
+	cfgMu        sync.Mutex
+	listener     *listener
 	mac          string
-	keepAliveSec int
+	keepAliveSec int32
+	h264Cfg      config.H264
+	recCfg       config.Recording
+	ringTimeout  time.Duration
+	// configured bell buttons
+	addresseeIds []int
+	outputs      []config.Output
+	camEvents    map[string]event.Type
 
 	conns     *list.List
 	audioConn *connection
 
 	client *mxpeg.Client
 
-	connListener net.Listener
-
 	runCtx      context.Context
 	runCancel   context.CancelFunc
 	runFinished chan struct{}
@@ -35,27 +50,62 @@ type Server struct {
 	cmdCh chan func()
 
 	codec *codec.Codec
+	// h264 encoder is shared by rtsp and hls streams
+	h264Users  int
+	videoEpoch time.Time
+	rtsp       *rtsp.Stream
+	hls        *hls.Stream
+
+	// clip recording
+	preroll  *recorder.Buffer
+	lastKey  time.Time
+	recPatch bool
+	rec      *recording
 
 	dht      []byte
 	dqt      []byte
 	patchDxt bool
+
+	// used for new clients when there is no codec
+	gop gopCache
+
+	// registered bell buttons
+	addressees []*addressee
+
+	ring      ringState
+	lastFrame time.Time
+	snapshots map[snapshotKey]*snapshot
+
+	stats stats
+
+	log log.Interface
 }
 
-func New(listenAddr string, mobotixAddr string, mobotixUser string, mobotixPass string, mac string, keepAliveSec int) *Server {
+func New(proxy *Proxy, cfg *config.Camera, keepAliveSec int, mac string) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Server{
-		listenAddr:   listenAddr,
+		proxy:        proxy,
+		name:         cfg.Name,
 		mac:          mac,
-		keepAliveSec: keepAliveSec,
+		addresseeIds: cfg.Addressees,
+		outputs:      cfg.Outputs,
+		keepAliveSec: int32(keepAliveSec),
 		conns:        list.New(),
+		snapshots:    make(map[snapshotKey]*snapshot),
+		preroll:      recorder.NewBuffer(0),
 		runCtx:       ctx,
 		runCancel:    cancel,
 		runFinished:  make(chan struct{}),
 		cmdCh:        make(chan func()),
+		log:          log.WithField("camera", cfg.Name),
 	}
 
-	s.client = mxpeg.NewClient(mobotixAddr, mobotixUser, mobotixPass, &mxpeg.Listener{
+	s.videoEpoch = time.Now()
+	s.rtsp = rtsp.NewStream(h264Source{s: s}, mxpeg.AudioSampleRate)
+	s.hls = hls.NewStream(h264Source{s: s})
+
+	s.client = mxpeg.NewClient(cfg.Addr, cfg.User, cfg.Pass, cfg.Auth, &mxpeg.Listener{
 		OnStreamStart: s.OnStreamStart,
 		OnStreamStop:  s.OnStreamStop,
 		OnEvent:       s.OnEvent,
@@ -66,69 +116,128 @@ func New(listenAddr string, mobotixAddr string, mobotixUser string, mobotixPass
 	return s
 }
 
-func (s *Server) Start() error {
-	ln, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
+// Start starts camera client and dedicated listener if listenAddr is not empty
+func (s *Server) Start(listenAddr string) error {
+	if err := s.listen(listenAddr); err != nil {
 		return err
 	}
 
-	s.connListener = ln
-
 	s.codec = codec.Create()
 
 	s.client.Start()
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Debug("finished accepting new connections")
-				break
-			}
+	go s.run()
+
+	return nil
+}
+
+// Reload applies new configuration without dropping connected clients.
+// Camera connection is restarted only when camera settings or mac are changed.
+func (s *Server) Reload(cfg *config.Camera, keepAliveSec int, mac string) error {
+	atomic.StoreInt32(&s.keepAliveSec, int32(keepAliveSec))
+
+	s.cfgMu.Lock()
+	macChanged := s.mac != mac
+	s.mac = mac
+	addresseesChanged := !equalIds(s.addresseeIds, cfg.Addressees)
+	s.addresseeIds = cfg.Addressees
+	s.outputs = cfg.Outputs
+	s.cfgMu.Unlock()
+
+	if s.client.Configure(cfg.Addr, cfg.User, cfg.Pass, cfg.Auth) || macChanged || addresseesChanged {
+		s.log.Info("camera settings changed, reconnecting")
+		s.client.Reconnect()
+	}
 
-			log.Debug("connection accepted")
+	return s.listen(cfg.Listen)
+}
 
-			s.setKeepalive(conn.(*net.TCPConn))
+func (s *Server) listen(addr string) error {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	old := s.listener
+	if old != nil && old.addr == addr {
+		return nil
+	}
 
-			handleConnection(s.runCtx, conn, s)
+	if addr != "" {
+		l, err := listen(s.runCtx, addr, s.proxy, s)
+		if err != nil {
+			return err
 		}
-	}()
 
-	go s.run()
+		s.log.WithField("addr", addr).Info("listening")
+		s.listener = l
+	} else {
+		s.listener = nil
+	}
+
+	if old != nil {
+		old.close()
+	}
 
 	return nil
 }
 
-func (s *Server) setKeepalive(conn *net.TCPConn) {
-	if conn.SetKeepAlive(true) != nil {
-		log.Warn("can't enable keepalive")
+func (s *Server) route(path string) (*Server, string) {
+	name, rest, ok := splitCameraPath(path)
+	if ok && name == s.name {
+		return s, rest
 	}
 
-	if conn.SetKeepAlivePeriod(time.Second*120) != nil {
-		log.Warn("can't set keepalive period")
-	}
+	return s, path
+}
 
-	rawConn, err := conn.SyscallConn()
-	if err != nil {
-		log.Warn("can't get raw connection")
-		return
-	}
+// configureOutputs applies settings of video outputs and recording
+func (s *Server) configureOutputs(cfg *config.Config) {
+	s.cfgMu.Lock()
+	s.h264Cfg = cfg.H264
+	s.recCfg = cfg.Recording
+	s.ringTimeout = cfg.RingTimeout
+	s.camEvents = cameraEventTypes(cfg.CameraEvents)
+	s.cfgMu.Unlock()
+
+	s.hls.Configure(cfg.HLS)
+}
 
-	err = rawConn.Control(func(fdPtr uintptr) {
-		fd := int(fdPtr)
+func (s *Server) h264Config() config.H264 {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
 
-		if syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3) != nil {
-			log.Warn("can't set number of probes")
-		}
+	return s.h264Cfg
+}
 
-		if syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 5) != nil {
-			log.Warn("can't set retry delay")
-		}
-	})
+func (s *Server) recordingConfig() config.Recording {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
 
-	if err != nil {
-		log.Warn("can't set additional keepalive paramteres")
-	}
+	return s.recCfg
+}
+
+func (s *Server) getRingTimeout() time.Duration {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	return s.ringTimeout
+}
+
+func (s *Server) getAddresseeIds() []int {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	return s.addresseeIds
+}
+
+func (s *Server) getMac() string {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	return s.mac
+}
+
+func (s *Server) keepAlive() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt32(&s.keepAliveSec))
 }
 
 func (s *Server) run() {
@@ -138,90 +247,227 @@ func (s *Server) run() {
 			cmd()
 		case _ = <-s.runCtx.Done():
 			close(s.runFinished)
-			_ = s.connListener.Close()
-			log.Debug("server finished run")
+
+			s.cfgMu.Lock()
+			if s.listener != nil {
+				s.listener.close()
+			}
+			s.cfgMu.Unlock()
+
+			if s.rec != nil {
+				s.stopRecording()
+			}
+
+			if s.ring.timer != nil {
+				s.ring.timer.Stop()
+			}
+
+			for e := s.conns.Front(); e != nil; e = e.Next() {
+				e.Value.(*connection).str.Close()
+			}
+
+			s.log.Debug("server finished run")
 			return
 		}
 	}
 }
 
+// exec runs cmd in server loop, cmd is dropped if server is stopped
+func (s *Server) exec(cmd func()) {
+	select {
+	case s.cmdCh <- cmd:
+	case <-s.runCtx.Done():
+	}
+}
+
+// call runs cmd in server loop and waits for completion, returns false if server is stopped
+func (s *Server) call(cmd func()) bool {
+	done := make(chan struct{})
+
+	s.exec(func() {
+		cmd()
+		close(done)
+	})
+
+	select {
+	case <-done:
+		return true
+	case <-s.runCtx.Done():
+		return false
+	}
+}
+
 func (s *Server) Stop() {
-	log.Info("stopping client")
+	s.log.Info("stopping client")
 	s.client.Stop()
-	log.Info("stopping server")
+	s.log.Info("stopping server")
+	s.rtsp.Close()
+	s.hls.Close()
 	s.runCancel()
 	<-s.runFinished
 	s.codec.Destroy()
-	log.Info("stopped")
+	s.log.Info("stopped")
 }
 
-func (s *Server) OnStreamStart() {
+func (s *Server) OnStreamStart(ctx context.Context) {
 	s.codec.OnStreamStart()
+	s.notify(event.CameraOnline, nil)
 
 	c := s.client
-	c.SendCmdSilent("mode", []string{"mxpeg"})
-	c.SendCmdSilent("audiooutput", []string{"pcm16"})
-	c.SendCmdSilent("live", []interface{}{false})
-	c.SendCmd("list_addressees", nil, func(evt map[string]interface{}) bool {
-		devId := jsonValue{v: evt}.mapGet("result").arrGet(0).arrGet(0).asInt()
-		c.SendCmd(
-			"add_device",
-			[]interface{}{s.mac, []int{devId}, "MoBell+" + s.mac},
-			func(evt map[string]interface{}) bool {
-				c.SendCmd("register_device", []string{s.mac}, s.onBell)
-				return true
-			},
-		)
-		return true
-	})
+	c.SendCmdSilent(protocol.MethodMode, protocol.ModeParams{Mode: protocol.ModeMxpeg})
+	c.SendCmdSilent(protocol.MethodAudioOutput, protocol.AudioOutputParams{Format: protocol.AudioPcm16})
+	c.SendCmdSilent(protocol.MethodLive, protocol.LiveParams{Enabled: false})
+
+	go s.registerDevice(ctx)
 }
 
-func (s *Server) onBell(evt map[string]interface{}) bool {
-	r := jsonValue{v: evt}.mapGet("result")
-	t := r.arrGet(0).asString()
+// registerDevice subscribes proxy to bell events, registration is retried until stream drops
+func (s *Server) registerDevice(ctx context.Context) {
+	for {
+		err := s.register(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
 
-	if t == "bell" {
-		isRing := r.arrGet(1).asBool()
-		log.WithField("ringing", isRing).Debug("received bell")
-		s.sendBell(isRing)
+		s.log.WithError(err).Warn("error registering device, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(registerRetryInterval):
+		}
 	}
+}
+
+func (s *Server) register(ctx context.Context) error {
+	c := s.client
+	mac := s.getMac()
 
-	return false
+	callCtx, cancel := context.WithTimeout(ctx, cameraCmdTimeout)
+	defer cancel()
+
+	m, err := c.Call(callCtx, protocol.MethodListAddressees, nil)
+	if err != nil {
+		return err
+	}
+
+	var r protocol.ListAddresseesResult
+	if err := m.DecodeResult(protocol.MethodListAddressees, &r); err != nil {
+		return err
+	}
+
+	all := newAddressees(r)
+	list := filterAddressees(all, s.getAddresseeIds())
+	if len(list) == 0 {
+		s.log.WithField("addressees", s.getAddresseeIds()).Warn("configured addressees are not found, using all")
+		list = all
+	}
+
+	s.exec(func() {
+		s.addressees = list
+	})
+
+	params := protocol.AddDeviceParams{Mac: mac, Addressees: addresseeIds(list), Name: "MoBell+" + mac}
+	if _, err := c.Call(callCtx, protocol.MethodAddDevice, params); err != nil {
+		return err
+	}
+
+	// events are received until stream drops
+	return c.Subscribe(ctx, protocol.MethodRegisterDevice, protocol.RegisterDeviceParams{Mac: mac}, s.onBell)
 }
 
-func (s *Server) sendBell(isRing bool) {
-	s.cmdCh <- func() {
-		for e := s.conns.Front(); e != nil; e = e.Next() {
-			e.Value.(*connection).sendBell(isRing)
+// onBell handles register_device events
+func (s *Server) onBell(m *protocol.Message) {
+	var e protocol.DeviceEvent
+	if err := m.DecodeResult(protocol.MethodRegisterDevice, &e); err != nil {
+		s.log.WithError(err).Warn("error decoding device event")
+		return
+	}
+
+	if e.Name == protocol.EventBell {
+		var b protocol.Bell
+		if err := m.DecodeResult(protocol.MethodRegisterDevice, &b); err != nil {
+			s.log.WithError(err).Warn("error decoding bell event")
+			return
+		}
+
+		isRing := b.Ringing
+		var a *addressee
+		if b.Addressee != nil {
+			a = newAddressee(*b.Addressee)
 		}
+		s.log.WithField("ringing", isRing).Debug("received bell")
+		if isRing {
+			atomic.AddUint64(&s.stats.bells, 1)
+		}
+
+		s.exec(func() {
+			if a == nil {
+				a = s.ringAddressee()
+			}
+
+			if isRing {
+				e := s.event(event.Bell, nil)
+				e.Addressee = &a.Addressee
+				e.Snapshot = s.codec.EncodeFrame()
+				s.proxy.publish(e)
+				s.startRecording()
+			} else {
+				e := s.event(event.BellStop, nil)
+				e.Addressee = &a.Addressee
+				s.proxy.publish(e)
+			}
+
+			s.bell(isRing, a)
+		})
+	} else {
+		s.onCameraEvent(e.Name, e.Params)
 	}
 }
 
-func (s *Server) OnStreamStop() {
-	s.codec.OnStreamStop()
+func (s *Server) sendBell(isRing bool) {
+	s.exec(func() {
+		s.bell(isRing, s.ringAddressee())
+	})
 }
 
-func (s *Server) OnEvent(_ map[string]interface{}) bool {
-	return true
+func (s *Server) OnStreamStop() {
+	s.codec.OnStreamStop()
+	s.notify(event.CameraOffline, nil)
+	s.exec(func() {
+		// new stream starts with new tables
+		s.preroll.Reset()
+		s.gop.reset()
+	})
 }
 
-func (s *Server) sendVideo(data []byte) {
+// sendVideo sends video or audio data to clients with enabled video and returns number of clients
+func (s *Server) sendVideo(data []byte) int {
+	n := 0
 	for e := s.conns.Front(); e != nil; e = e.Next() {
 		c := e.Value.(*connection)
 		if c.videoEnabled {
 			c.send(data)
+			n++
 		}
 	}
+
+	atomic.AddUint64(&s.stats.bytesSent, uint64(n*len(data)))
+
+	return n
 }
 
 func (s *Server) OnVideo(data []byte, frameStart bool) {
 	if !s.codec.OnVideoPacket(data) {
-		log.Error("error decoding video frame")
+		s.log.Error("error decoding video frame")
+		atomic.AddUint64(&s.stats.decodeErrors, 1)
 		s.client.Reconnect()
 		return
 	}
 
-	s.cmdCh <- func() {
+	s.encodeH264()
+
+	s.exec(func() {
 		// we need to store dqt and dht from original stream
 		// we will patch motion frames with this values right after key frame generation
 		dqt, dht := mxpeg.ExtractDqtDht(data)
@@ -232,30 +478,44 @@ func (s *Server) OnVideo(data []byte, frameStart bool) {
 			s.dht = dht
 		}
 
+		if !codec.Enabled {
+			s.gop.add(data, frameStart)
+		}
+
 		// patch
 		if s.patchDxt {
 			s.patchDxt = false
 			data = mxpeg.PatchDqtDht(data, s.dqt, s.dht)
 		}
 
-		s.sendVideo(data)
-	}
+		s.lastFrame = time.Now()
+
+		s.record(data, true, frameStart)
+
+		n := s.sendVideo(data)
+		atomic.AddUint64(&s.stats.framesSent, uint64(n))
+	})
 }
 
 func (s *Server) OnAudio(data []byte) {
-	s.cmdCh <- func() {
-		s.sendVideo(data)
+	if s.rtsp.Active() {
+		s.rtsp.WriteAudio(mxpeg.AudioSamples(data), time.Now())
 	}
+
+	s.exec(func() {
+		s.record(data, false, false)
+		s.sendVideo(data)
+	})
 }
 
 func (s *Server) addConnection(conn *connection) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		s.conns.PushBack(conn)
-	}
+	})
 }
 
 func (s *Server) delConnection(conn *connection) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		for e := s.conns.Front(); e != nil; e = e.Next() {
 			if e.Value == conn {
 				s.conns.Remove(e)
@@ -267,95 +527,150 @@ func (s *Server) delConnection(conn *connection) {
 			// send stop command, cause it was not sent by connection itself
 			s.client.Write(audioStopEvt)
 		}
-	}
+	})
 }
 
 func (s *Server) enableVideo(conn *connection) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		if !conn.videoEnabled {
 			conn.videoEnabled = true
-			data := s.codec.EncodeFrame()
-			if data != nil {
-				conn.send(data)
+			if codec.Enabled {
+				data := s.codec.EncodeFrame()
+				if data != nil {
+					conn.send(data)
+				}
+			} else {
+				// client decodes last key frame and all following frames to get current picture
+				for _, data := range s.gop.frames {
+					conn.send(data)
+				}
 			}
 		}
 
 		s.patchDxt = true
-	}
+	})
 }
 
 func (s *Server) audioStart(conn *connection, data []byte) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		if s.audioConn == nil {
-			log.Debug("audio recording started")
+			s.log.Debug("audio recording started")
 			s.audioConn = conn
 			s.client.Write(data)
 		} else {
-			log.Debug("can't start audio recording - busy with another connection")
+			s.log.Debug("can't start audio recording - busy with another connection")
 		}
-	}
+	})
 }
 
 func (s *Server) audioStop(conn *connection, data []byte) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		if s.audioConn == conn {
-			log.Debug("audio recording stopped")
+			s.log.Debug("audio recording stopped")
 			s.audioConn = nil
 			s.client.Write(data)
 		} else {
-			log.Debug("can't stop audio recording - busy with another connection")
+			s.log.Debug("can't stop audio recording - busy with another connection")
 		}
-	}
+	})
 }
 
 func (s *Server) audioData(conn *connection, data []byte) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		if s.audioConn == conn {
 			s.client.Write(data)
 		}
-	}
+	})
+}
+
+// kick closes client connection, returns false if there is no such connection
+func (s *Server) kick(id uint64) bool {
+	found := false
+
+	s.call(func() {
+		for e := s.conns.Front(); e != nil; e = e.Next() {
+			c := e.Value.(*connection)
+			if c.id == id {
+				c.log.Info("kicking client")
+				c.str.Close()
+				found = true
+			}
+		}
+	})
+
+	return found
 }
 
+// registerBell subscribes client to bell events, client gets current state immediately
 func (s *Server) registerBell(conn *connection, evtId int) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		conn.bellEvtId = evtId
+		s.sendRingState(conn)
+	})
+}
+
+// event creates new event, conn is a client which caused event and may be nil
+func (s *Server) event(t event.Type, conn *connection) event.Event {
+	e := event.New(t, s.name)
+	if conn != nil {
+		e.User = conn.user
+		e.Client = conn.remoteAddr
 	}
+
+	return e
+}
+
+// notify publishes event, conn is a client which caused event and may be nil
+func (s *Server) notify(t event.Type, conn *connection) {
+	s.proxy.publish(s.event(t, conn))
 }
 
 type notifyAction func(*connection)
 
 func (s *Server) notifyOthers(conn *connection, na notifyAction) {
-	s.cmdCh <- func() {
+	s.exec(func() {
 		for e := s.conns.Front(); e != nil; e = e.Next() {
 			c := e.Value.(*connection)
 			if c != conn {
 				na(c)
 			}
 		}
-	}
+	})
 }
 
-func (s *Server) bellResp(conn *connection, method string, params interface{}) {
-	s.client.SendCmdSilent(method, params)
+func (s *Server) bellResp(conn *connection, t event.Type, method string, params interface{}, done cmdDone) {
+	s.cameraCmd(method, params, done)
+	s.exec(func() {
+		s.answer(t, conn)
+		s.answerRecording()
+	})
 	s.notifyOthers(conn, func(c *connection) {
-		c.sendBell(false)
+		c.sendBell(false, s.ringAddressee())
 	})
 }
 
-func (s *Server) bellAck(conn *connection) {
-	s.bellResp(conn, "bell_ack", []interface{}{true})
+func (s *Server) bellAck(conn *connection, done cmdDone) {
+	atomic.AddUint64(&s.stats.bellAcks, 1)
+	s.notify(event.Answer, conn)
+	s.bellResp(conn, event.Answer, protocol.MethodBellAck, protocol.BellAckParams{Ack: true}, done)
 }
 
-func (s *Server) bellReject(conn *connection) {
-	s.bellResp(conn, "bell_ack", []interface{}{false})
+func (s *Server) bellReject(conn *connection, done cmdDone) {
+	s.notify(event.Reject, conn)
+	s.bellResp(conn, event.Reject, protocol.MethodBellAck, protocol.BellAckParams{Ack: false}, done)
 }
 
 func (s *Server) bellSupress(conn *connection) {
+	s.notify(event.Suppress, conn)
 	s.notifyOthers(conn, func(c *connection) {
 		c.sendSuppress()
 	})
 }
 
-func (s *Server) openDoor(conn *connection) {
-	s.bellResp(conn, "trigger", []interface{}{"door"})
+func (s *Server) openDoor(conn *connection, done cmdDone) {
+	atomic.AddUint64(&s.stats.doorOpens, 1)
+	e := s.event(event.Door, conn)
+	e.Output = config.DoorOutput
+	s.proxy.publish(e)
+	s.bellResp(conn, event.Door, protocol.MethodTrigger, protocol.TriggerParams{Output: config.DoorOutput}, done)
 }
@@ -0,0 +1,127 @@
+package mobell
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// snapshots with same parameters are not encoded again during this interval
+const snapshotCacheTime = time.Second
+
+const maxSnapshotWidth = 4096
+
+var errNoFrame = errors.New("no video frame")
+
+type snapshotKey struct {
+	width   int
+	quality int
+}
+
+type snapshot struct {
+	data []byte
+	// encoding time
+	time time.Time
+	// time of last received frame when snapshot was encoded
+	frame time.Time
+}
+
+// encodeSnapshot returns cached or newly encoded jpeg, must be called from server loop.
+// Cached snapshot is used when it is younger than maxAge or there were no frames since encoding.
+func (s *Server) encodeSnapshot(width int, quality int, maxAge time.Duration) *snapshot {
+	key := snapshotKey{width: width, quality: quality}
+	now := time.Now()
+
+	if sn, ok := s.snapshots[key]; ok && (now.Sub(sn.time) < maxAge || !s.lastFrame.After(sn.frame)) {
+		return sn
+	}
+
+	// drop outdated snapshots
+	for k, sn := range s.snapshots {
+		if now.Sub(sn.time) >= snapshotCacheTime {
+			delete(s.snapshots, k)
+		}
+	}
+
+	data := s.codec.EncodeJpeg(width, quality)
+	if data == nil {
+		return nil
+	}
+
+	sn := &snapshot{data: data, time: now, frame: s.lastFrame}
+	s.snapshots[key] = sn
+
+	return sn
+}
+
+// snapshot returns jpeg of current frame, errNoFrame is returned when camera stream is down
+func (s *Server) snapshot(width int, quality int, maxAge time.Duration) (*snapshot, error) {
+	if !s.client.Connected() {
+		return nil, errNoFrame
+	}
+
+	var sn *snapshot
+	if !s.call(func() {
+		sn = s.encodeSnapshot(width, quality, maxAge)
+	}) {
+		return nil, errNoFrame
+	}
+
+	if sn == nil {
+		return nil, errNoFrame
+	}
+
+	return sn, nil
+}
+
+// intParam returns query parameter in range [min, max] or zero if parameter is not set
+func intParam(r *http.Request, name string, min int, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min || i > max {
+		return 0, errors.New("bad " + name)
+	}
+
+	return i, nil
+}
+
+// handleSnapshot handles /snapshot.jpg?width=<px>&quality=<1-100>
+func (p *Proxy) handleSnapshot(w http.ResponseWriter, r *http.Request, s *Server) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	width, err := intParam(r, "width", 1, maxSnapshotWidth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	quality, err := intParam(r, "quality", 1, 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sn, err := s.snapshot(width, quality, snapshotCacheTime)
+	if err != nil {
+		cameraUnavailable(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(sn.data)))
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(sn.data)
+}
+
+func cameraUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "camera is not available", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,122 @@
+package mobell
+
+import (
+	"io"
+	"mobell-proxy/mobell/metrics"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// stats are updated atomically
+type stats struct {
+	bytesSent    uint64
+	framesSent   uint64
+	decodeErrors uint64
+	bells        uint64
+	bellAcks     uint64
+	doorOpens    uint64
+}
+
+// metrics are not authorized, so clients are identified by connection id only
+type clientStats struct {
+	id       uint64
+	queueLen int
+}
+
+type serverStats struct {
+	name         string
+	connected    bool
+	reconnects   uint64
+	clients      []clientStats
+	videoClients int
+	stats        stats
+}
+
+func (s *Server) collectStats() serverStats {
+	st := serverStats{
+		name:       s.name,
+		connected:  s.client.Connected(),
+		reconnects: s.client.Reconnects(),
+		stats: stats{
+			bytesSent:    atomic.LoadUint64(&s.stats.bytesSent),
+			framesSent:   atomic.LoadUint64(&s.stats.framesSent),
+			decodeErrors: atomic.LoadUint64(&s.stats.decodeErrors),
+			bells:        atomic.LoadUint64(&s.stats.bells),
+			bellAcks:     atomic.LoadUint64(&s.stats.bellAcks),
+			doorOpens:    atomic.LoadUint64(&s.stats.doorOpens),
+		},
+	}
+
+	s.call(func() {
+		for e := s.conns.Front(); e != nil; e = e.Next() {
+			c := e.Value.(*connection)
+			st.clients = append(st.clients, clientStats{
+				id:       c.id,
+				queueLen: c.str.QueueLen(),
+			})
+			if c.videoEnabled {
+				st.videoClients++
+			}
+		}
+	})
+
+	return st
+}
+
+func (p *Proxy) writeMetrics(out io.Writer) error {
+	var all []serverStats
+	for _, s := range p.serverList() {
+		all = append(all, s.collectStats())
+	}
+
+	w := metrics.NewWriter(out)
+
+	type metric struct {
+		name  string
+		t     metrics.Type
+		help  string
+		value func(st *serverStats) float64
+	}
+
+	for _, m := range []metric{
+		{"mobell_clients", metrics.Gauge, "Number of connected clients.",
+			func(st *serverStats) float64 { return float64(len(st.clients)) }},
+		{"mobell_video_clients", metrics.Gauge, "Number of clients with enabled video.",
+			func(st *serverStats) float64 { return float64(st.videoClients) }},
+		{"mobell_camera_connected", metrics.Gauge, "Camera event stream state.",
+			func(st *serverStats) float64 { return metrics.Bool(st.connected) }},
+		{"mobell_camera_reconnects_total", metrics.Counter, "Number of camera reconnects.",
+			func(st *serverStats) float64 { return float64(st.reconnects) }},
+		{"mobell_sent_bytes_total", metrics.Counter, "Video and audio bytes forwarded to clients.",
+			func(st *serverStats) float64 { return float64(st.stats.bytesSent) }},
+		{"mobell_sent_frames_total", metrics.Counter, "Video frames forwarded to clients.",
+			func(st *serverStats) float64 { return float64(st.stats.framesSent) }},
+		{"mobell_decode_errors_total", metrics.Counter, "Video frame decoding errors.",
+			func(st *serverStats) float64 { return float64(st.stats.decodeErrors) }},
+		{"mobell_bells_total", metrics.Counter, "Number of rings.",
+			func(st *serverStats) float64 { return float64(st.stats.bells) }},
+		{"mobell_bell_acks_total", metrics.Counter, "Number of answered rings.",
+			func(st *serverStats) float64 { return float64(st.stats.bellAcks) }},
+		{"mobell_door_opens_total", metrics.Counter, "Number of door open commands.",
+			func(st *serverStats) float64 { return float64(st.stats.doorOpens) }},
+	} {
+		for i := range all {
+			w.Write(m.name, m.t, m.help, m.value(&all[i]), "camera", all[i].name)
+		}
+	}
+
+	for i := range all {
+		for _, c := range all[i].clients {
+			w.Write("mobell_client_queue_length", metrics.Gauge, "Number of packets waiting to be sent to client.",
+				float64(c.queueLen), "camera", all[i].name, "client", strconv.FormatUint(c.id, 10))
+		}
+	}
+
+	return w.Flush()
+}
+
+func (p *Proxy) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	_ = p.writeMetrics(w)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/apex/log"
 	"mobell-proxy/mobell/syncchan"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,8 +18,9 @@ type Stream struct {
 	conn   net.Conn
 
 	asyncCh *syncchan.Chan
-	syncCh  chan []byte
+	syncCh  chan interface{}
 	queue   *list.List
+	queued  int32
 
 	log log.Interface
 }
@@ -44,7 +46,7 @@ func NewStream(ctx context.Context, conn net.Conn, log log.Interface) *Stream {
 		conn:   conn,
 
 		asyncCh: syncchan.MakeChan(1),
-		syncCh:  make(chan []byte),
+		syncCh:  make(chan interface{}),
 		queue:   list.New(),
 
 		log: log,
@@ -66,6 +68,16 @@ func (s *Stream) Close() {
 	s.cancel()
 }
 
+// finish is queued after data to close stream when all data is written
+type finish struct{}
+
+// Finish closes stream after all queued data is written
+func (s *Stream) Finish() {
+	if s.asyncCh.Push(finish{}) != nil {
+		s.Close()
+	}
+}
+
 func (s *Stream) close() {
 	_ = s.conn.Close()
 	s.asyncCh.Close()
@@ -78,20 +90,27 @@ func (s *Stream) Read(buf []byte) (int, error) {
 
 func (s *Stream) Write(data []byte) (int, error) {
 	// we may ignore send errors
-	_ = s.asyncCh.Push(data)
+	if s.asyncCh.Push(data) == nil {
+		atomic.AddInt32(&s.queued, 1)
+	}
 	return len(data), nil
 }
 
+// QueueLen returns number of packets waiting to be written
+func (s *Stream) QueueLen() int {
+	return int(atomic.LoadInt32(&s.queued))
+}
+
 func (s *Stream) queueData() {
-	var data []byte
+	var data interface{}
 
 	for {
-		var syncCh chan []byte
+		var syncCh chan interface{}
 
 		if data == nil {
 			e := s.queue.Front()
 			if e != nil {
-				data = s.queue.Remove(e).([]byte)
+				data = s.queue.Remove(e)
 			}
 		}
 
@@ -115,8 +134,15 @@ func (s *Stream) queueData() {
 
 func (s *Stream) writeData() {
 	for {
-		data, ok := <-s.syncCh
+		d, ok := <-s.syncCh
+		if !ok {
+			return
+		}
+
+		data, ok := d.([]byte)
 		if !ok {
+			// finish marker
+			s.Close()
 			return
 		}
 
@@ -131,5 +157,7 @@ func (s *Stream) writeData() {
 
 			data = data[nr:]
 		}
+
+		atomic.AddInt32(&s.queued, -1)
 	}
 }
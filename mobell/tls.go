@@ -0,0 +1,155 @@
+package mobell
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/apex/log"
+	"mobell-proxy/mobell/config"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often certificate files are checked for changes
+const certCheckInterval = time.Second * 5
+
+// certStore provides tls config for client listeners and reloads certificates when files are changed
+type certStore struct {
+	cfg config.TLS
+
+	mu        sync.Mutex
+	tlsCfg    *tls.Config
+	modTime   time.Time
+	checkTime time.Time
+}
+
+func newCertStore(cfg config.TLS) (*certStore, error) {
+	cs := &certStore{cfg: cfg}
+
+	tlsCfg, modTime, err := cs.load()
+	if err != nil {
+		return nil, err
+	}
+
+	cs.tlsCfg = tlsCfg
+	cs.modTime = modTime
+	cs.checkTime = time.Now()
+
+	return cs, nil
+}
+
+func (cs *certStore) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cs.current(), nil
+		},
+	}
+}
+
+func (cs *certStore) current() *tls.Config {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(cs.checkTime) < certCheckInterval {
+		return cs.tlsCfg
+	}
+	cs.checkTime = now
+
+	modTime, err := cs.lastModified()
+	if err != nil {
+		log.WithError(err).Warn("can't check certificate files")
+		return cs.tlsCfg
+	}
+
+	if modTime.After(cs.modTime) {
+		tlsCfg, modTime, err := cs.load()
+		if err != nil {
+			log.WithError(err).Error("error reloading certificates, keeping old ones")
+			// don't try to reload same broken files again
+			cs.modTime = modTime
+		} else {
+			log.Info("certificates reloaded")
+			cs.tlsCfg = tlsCfg
+			cs.modTime = modTime
+		}
+	}
+
+	return cs.tlsCfg
+}
+
+func (cs *certStore) files() []string {
+	files := []string{cs.cfg.Cert, cs.cfg.Key}
+	if cs.cfg.ClientCA != "" {
+		files = append(files, cs.cfg.ClientCA)
+	}
+
+	return files
+}
+
+func (cs *certStore) lastModified() (time.Time, error) {
+	var t time.Time
+
+	for _, f := range cs.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+
+	return t, nil
+}
+
+func (cs *certStore) load() (*tls.Config, time.Time, error) {
+	// modification time is taken before reading, so we'll never miss a change
+	modTime, err := cs.lastModified()
+	if err != nil {
+		return nil, modTime, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cs.cfg.Cert, cs.cfg.Key)
+	if err != nil {
+		return nil, modTime, err
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if cs.cfg.ClientCA != "" {
+		data, err := os.ReadFile(cs.cfg.ClientCA)
+		if err != nil {
+			return nil, modTime, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, modTime, errors.New("no certificates found in client ca file")
+		}
+
+		tlsCfg.ClientCAs = pool
+		if cs.cfg.ClientCertRequired {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsCfg, modTime, nil
+}
+
+// clientCertUser returns common name from verified client certificate
+func clientCertUser(st *tls.ConnectionState) string {
+	if len(st.VerifiedChains) == 0 || len(st.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return st.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"mobell-proxy/mobell/config"
+	"mobell-proxy/mobell/event"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const SignatureHeader = "X-Mobell-Signature"
+
+// number of events waiting for delivery per webhook, new events are dropped on overflow
+const queueSize = 64
+
+// max time for delivery of queued events after stop
+const drainTimeout = time.Minute
+
+type hook struct {
+	cfg    config.Webhook
+	events map[event.Type]bool
+	body   *template.Template
+	queue  chan event.Event
+	client *http.Client
+	log    log.Interface
+}
+
+// Dispatcher delivers events to webhooks in background
+type Dispatcher struct {
+	hooks []*hook
+
+	stopOnce sync.Once
+	stopping chan struct{}
+
+	runCtx    context.Context
+	runCancel context.CancelFunc
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func New(cfg []config.Webhook) (*Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &Dispatcher{
+		stopping:  make(chan struct{}),
+		runCtx:    ctx,
+		runCancel: cancel,
+	}
+
+	for i, c := range cfg {
+		h := &hook{
+			cfg:    c,
+			queue:  make(chan event.Event, queueSize),
+			client: &http.Client{Timeout: c.Timeout},
+			log:    log.WithField("webhook", c.URL),
+		}
+
+		if len(c.Events) > 0 {
+			h.events = make(map[event.Type]bool)
+			for _, t := range c.Events {
+				if !event.Type(t).Valid() {
+					cancel()
+					return nil, fmt.Errorf("webhook %s: unknown event '%s'", c.URL, t)
+				}
+				h.events[event.Type(t)] = true
+			}
+		}
+
+		if c.Body != "" {
+			t, err := template.New(fmt.Sprintf("webhook%d", i)).Funcs(funcs).Parse(c.Body)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("webhook %s: %w", c.URL, err)
+			}
+			h.body = t
+		}
+
+		d.hooks = append(d.hooks, h)
+	}
+
+	for _, h := range d.hooks {
+		go h.run(ctx, d.stopping)
+	}
+
+	return d, nil
+}
+
+// Stop stops dispatcher without waiting, queued events and current retries are delivered
+// in background, they are cancelled after drain timeout
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopping)
+		time.AfterFunc(drainTimeout, d.runCancel)
+	})
+}
+
+func (d *Dispatcher) Publish(e event.Event) {
+	for _, h := range d.hooks {
+		if h.events != nil && !h.events[e.Type] {
+			continue
+		}
+
+		select {
+		case h.queue <- e:
+		default:
+			h.log.WithField("event", e.Type).Warn("queue is full, dropping event")
+		}
+	}
+}
+
+func (h *hook) run(ctx context.Context, stopping chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopping:
+			h.drain(ctx)
+			return
+		case e := <-h.queue:
+			h.deliver(ctx, e)
+		}
+	}
+}
+
+// drain delivers queued events
+func (h *hook) drain(ctx context.Context) {
+	for {
+		select {
+		case e := <-h.queue:
+			h.deliver(ctx, e)
+		default:
+			return
+		}
+	}
+}
+
+func (h *hook) deliver(ctx context.Context, e event.Event) {
+	body, err := h.render(e)
+	if err != nil {
+		h.log.WithError(err).Error("error rendering body")
+		return
+	}
+
+	delay := h.cfg.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		retry, err := h.send(ctx, body)
+		if err == nil {
+			h.log.WithField("event", e.Type).Debug("event delivered")
+			return
+		}
+
+		if !retry || attempt >= h.cfg.Retries {
+			h.log.WithError(err).WithField("event", e.Type).Error("event delivery failed")
+			return
+		}
+
+		h.log.WithError(err).WithField("delay", delay).Warn("event delivery failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+func (h *hook) render(e event.Event) ([]byte, error) {
+	if h.body == nil {
+		return json.Marshal(e)
+	}
+
+	var b bytes.Buffer
+	if err := h.body.Execute(&b, e); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// send returns true if request may be retried on error
+func (h *hook) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if h.cfg.Secret != "" {
+		m := hmac.New(sha256.New, []byte(h.cfg.Secret))
+		m.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}